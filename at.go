@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A one-off task submitted through the http interface. It runs once at 'At' like a job with the same
+// command and options, then it's removed. Pending tasks are kept in state.json.
+type atTask struct {
+	ID      int       `json:"id"`
+	At      time.Time `json:"at"`
+	Created time.Time `json:"created"`
+	jobDef            // command and job options, as in jobs.json; no name or schedule
+}
+
+// Returns the job that runs the task. Its runs are recorded as job at-<id>, from at:<id>.
+func (t *atTask) toJob() (*job, error) {
+	d := t.jobDef
+	if d.Name != "" || d.Schedule != "" {
+		return nil, fmt.Errorf("name and schedule are not allowed in a task")
+	}
+
+	d.Schedule = "@manual"
+	j, err := d.toJob(defaultJob())
+	if err != nil {
+		return nil, err
+	}
+
+	j.name = fmt.Sprintf("at-%d", t.ID)
+	j.src, j.line = "at", t.ID
+	return j, nil
+}
+
+// Add a task. Returns the task with its id.
+func (c *svcContext) addTask(t atTask) (*atTask, error) {
+	if t.At.IsZero() {
+		return nil, fmt.Errorf("missing at (RFC3339 time)")
+	}
+
+	if _, err := t.toJob(); err != nil {
+		return nil, err
+	}
+
+	cf := c.config()
+	for _, name := range append(t.OnSuccess, t.OnFailure...) {
+		if cf.job(name) == nil {
+			return nil, fmt.Errorf("chained job not found: %s", name)
+		}
+	}
+
+	c.mtx.Lock()
+	c.taskSeq++
+	t.ID, t.Created = c.taskSeq, time.Now()
+	c.tasks[t.ID] = &t
+	c.mtx.Unlock()
+	if err := c.saveState(); err != nil {
+		c.mtx.Lock()
+		delete(c.tasks, t.ID)
+		c.mtx.Unlock()
+		return nil, err
+	}
+
+	c.traceInfo("at:", t.ID, ": task added, runs at ", t.At)
+	c.wakeUp()
+	return &t, nil
+}
+
+// Remove a pending task.
+func (c *svcContext) cancelTask(id int) error {
+	c.mtx.Lock()
+	_, ok := c.tasks[id]
+	delete(c.tasks, id)
+	c.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("task not found: %d", id)
+	}
+
+	c.traceInfo("at:", id, ": task cancelled")
+	return c.saveState()
+}
+
+// Returns the pending tasks in run order. Call with c.mtx held.
+func (c *svcContext) pendingTasks() []*atTask {
+	tasks := []*atTask{}
+	for _, t := range c.tasks {
+		tasks = append(tasks, t)
+	}
+
+	sort.Slice(tasks, func(i, k int) bool {
+		if !tasks[i].At.Equal(tasks[k].At) {
+			return tasks[i].At.Before(tasks[k].At)
+		}
+
+		return tasks[i].ID < tasks[k].ID
+	})
+
+	return tasks
+}
+
+// Start the tasks due at 'now' (including the ones missed while the service was stopped or paused)
+// and remove them.
+func (c *svcContext) runDueTasks(now time.Time) {
+	var due []*atTask
+	c.mtx.Lock()
+	for _, t := range c.pendingTasks() {
+		if t.At.After(now) {
+			break
+		}
+
+		due = append(due, t)
+		delete(c.tasks, t.ID)
+	}
+
+	c.mtx.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	if err := c.saveState(); err != nil {
+		c.traceError("Cannot save state: ", err)
+	}
+
+	for _, t := range due {
+		j, err := t.toJob()
+		if err != nil {
+			c.traceError("at:", t.ID, ": ", err)
+			continue
+		}
+
+		c.traceInfo(j.where(), ": task due at ", t.At)
+		c.dispatchDelayed(j, []time.Time{now})
+	}
+}
+
+// Returns the next time the main loop should evaluate: the next fire time of any job (see
+// config.nextWake) or the time of the next task, rounded up to the second.
+func (c *svcContext) nextWake(t time.Time) time.Time {
+	wake := c.config().nextWake(t)
+	c.mtx.Lock()
+	tasks := c.pendingTasks()
+	c.mtx.Unlock()
+	if len(tasks) == 0 || !tasks[0].At.Before(wake) {
+		return wake
+	}
+
+	at := tasks[0].At.Truncate(time.Second)
+	if at.Before(tasks[0].At) {
+		at = at.Add(time.Second)
+	}
+
+	if !at.After(t) {
+		at = t.Add(time.Second)
+	}
+
+	return at
+}
+
+// Make the main loop compute its wake up time again, i.e. after a task is added.
+func (c *svcContext) wakeUp() {
+	select {
+	case c.wakec <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A blackout window in jobs.json, state.json and the http interface. A window is either recurring
+// (starts on 'Schedule' and lasts 'Duration') or absolute ('From' to 'To').
+type blackoutDef struct {
+	ID       int      `json:"id,omitempty"`       // windows added through the http interface
+	Schedule string   `json:"schedule,omitempty"` // i.e. "0 22 * * FRI" or "@daily"
+	Duration string   `json:"duration,omitempty"`
+	TZ       string   `json:"tz,omitempty"`   // for 'Schedule'
+	From     string   `json:"from,omitempty"` // RFC3339
+	To       string   `json:"to,omitempty"`
+	Tags     []string `json:"tags,omitempty"` // jobs with any of these tags; all jobs if empty
+}
+
+// A window during which jobs are not started.
+type blackout struct {
+	def   blackoutDef
+	src   string // i.e. run.conf:3, or api:<id> for windows added through the http interface
+	sched schedule
+	dur   time.Duration
+	from  time.Time
+	to    time.Time
+}
+
+// Parse a window; 'loc' is the time zone of the schedule unless the window has its own.
+func (d *blackoutDef) toBlackout(loc *time.Location) (*blackout, error) {
+	b := blackout{def: *d}
+	for _, tag := range d.Tags {
+		if tag == "" || strings.ContainsAny(tag, ", ") {
+			return nil, fmt.Errorf("tags: invalid tag %q", tag)
+		}
+	}
+
+	if d.Schedule == "" {
+		if d.Duration != "" || d.TZ != "" {
+			return nil, fmt.Errorf("duration and tz need a schedule")
+		}
+
+		var err error
+		if b.from, err = time.Parse(time.RFC3339, d.From); err != nil {
+			return nil, fmt.Errorf("from: expected an RFC3339 time, got %q", d.From)
+		}
+
+		if b.to, err = time.Parse(time.RFC3339, d.To); err != nil {
+			return nil, fmt.Errorf("to: expected an RFC3339 time, got %q", d.To)
+		}
+
+		if !b.to.After(b.from) {
+			return nil, fmt.Errorf("to should be after from")
+		}
+
+		return &b, nil
+	}
+
+	if d.From != "" || d.To != "" {
+		return nil, fmt.Errorf("a window has either a schedule or from and to")
+	}
+
+	d2, err := time.ParseDuration(d.Duration)
+	if err != nil || d2 <= 0 {
+		return nil, fmt.Errorf("duration: invalid duration %q (i.e. 30m, 4h)", d.Duration)
+	}
+
+	if d.TZ != "" {
+		if loc, err = loadCronLocation(d.TZ); err != nil {
+			return nil, err
+		}
+	}
+
+	sched, err := parseSchedule(d.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s := sched.(type) {
+	case rebootSchedule, manualSchedule:
+		return nil, fmt.Errorf("%s cannot start a window", d.Schedule)
+	case *cronSchedule:
+		if s.loc == nil {
+			s.loc = loc
+		}
+	}
+
+	b.sched, b.dur = sched, d2
+	return &b, nil
+}
+
+// Parse the rest of a '@blackout' run.conf line: 'key=value' items (duration, tags, CRON_TZ or TZ,
+// from and to), then the schedule of a recurring window:
+//
+//	@blackout duration=4h tags=web,db 0 22 * * FRI
+//	@blackout from=2024-01-10T09:00:00+09:00 to=2024-01-10T18:00:00+09:00
+func parseBlackoutLine(s string, def job) (*blackout, error) {
+	var d blackoutDef
+	for {
+		item, rest, ok, err := nextArg(s, def.quoting)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok || !strings.Contains(item, "=") {
+			break
+		}
+
+		s = rest
+		kv := strings.SplitN(item, "=", 2)
+		switch kv[0] {
+		case "duration":
+			d.Duration = kv[1]
+		case "tags":
+			d.Tags = strings.Split(kv[1], ",")
+		case "CRON_TZ", "TZ":
+			d.TZ = kv[1]
+		case "from":
+			d.From = kv[1]
+		case "to":
+			d.To = kv[1]
+		default:
+			return nil, fmt.Errorf("unknown blackout option %q", kv[0])
+		}
+	}
+
+	d.Schedule = strings.Join(strings.Fields(s), " ")
+	return d.toBlackout(def.loc)
+}
+
+// Returns true if 't' is within the window.
+func (b *blackout) active(t time.Time) bool {
+	return !b.startAt(t).IsZero()
+}
+
+// Returns the start of the window 't' is in, zero if 't' is not within the window.
+func (b *blackout) startAt(t time.Time) time.Time {
+	if b.sched == nil {
+		if !t.Before(b.from) && t.Before(b.to) {
+			return b.from
+		}
+
+		return time.Time{}
+	}
+
+	// The last start before 't' is the first one after t - duration.
+	start := b.sched.next(t.Add(-b.dur))
+	if start.After(t) {
+		return time.Time{}
+	}
+
+	return start
+}
+
+// Returns the start of the next window after 't', zero if there is none.
+func (b *blackout) next(t time.Time) time.Time {
+	if b.sched == nil {
+		if b.from.After(t) {
+			return b.from
+		}
+
+		return time.Time{}
+	}
+
+	return b.sched.next(t)
+}
+
+// Returns true if the window applies to job 'j'.
+func (b *blackout) applies(j *job) bool {
+	if len(b.def.Tags) == 0 {
+		return true
+	}
+
+	for _, tag := range b.def.Tags {
+		for _, jt := range j.tags {
+			if tag == jt {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the window (from the config or added through the http interface) job 'j' is in at 't',
+// or nil.
+func (c *svcContext) activeBlackout(j *job, t time.Time) *blackout {
+	for _, b := range c.allBlackouts() {
+		if b.applies(j) && b.active(t) {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// Returns the windows from the config, then the ones added through the http interface.
+func (c *svcContext) allBlackouts() []*blackout {
+	all := append([]*blackout{}, c.config().blackouts...)
+	c.mtx.Lock()
+	var ids []int
+	for id := range c.blackouts {
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+	for _, id := range ids {
+		all = append(all, c.blackouts[id])
+	}
+
+	c.mtx.Unlock()
+	return all
+}
+
+// Returns true if job 'j' is in a blackout window now. The run is then recorded as skipped.
+func (c *svcContext) blackedOut(j *job) bool {
+	now := time.Now()
+	b := c.activeBlackout(j, now)
+	if b == nil {
+		return false
+	}
+
+	args, _, _ := j.command()
+	run := jobRun{
+		job:      j.id(),
+		source:   j.where(),
+		args:     args,
+		start:    now,
+		end:      now,
+		status:   RUN_SKIPPED,
+		exitCode: -1,
+		err:      fmt.Errorf("blackout: %s", b.src),
+	}
+
+	c.mtx.Lock()
+	c.jobState(j.id()).last = newRunRecord(&run)
+	c.mtx.Unlock()
+	go c.record(&run) // not on the service's main loop
+	return true
+}
+
+// Add a window through the http interface. It's kept in state.json. Returns the window with its id.
+func (c *svcContext) addBlackout(d blackoutDef) (*blackout, error) {
+	d.ID = 0
+	b, err := d.toBlackout(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	c.blackoutSeq++
+	b.def.ID = c.blackoutSeq
+	b.src = fmt.Sprintf("api:%d", b.def.ID)
+	c.blackouts[b.def.ID] = b
+	c.mtx.Unlock()
+	if err := c.saveState(); err != nil {
+		c.mtx.Lock()
+		delete(c.blackouts, b.def.ID)
+		c.mtx.Unlock()
+		return nil, err
+	}
+
+	c.traceInfo(b.src, ": blackout window added")
+	return b, nil
+}
+
+// Remove a window added through the http interface.
+func (c *svcContext) removeBlackout(id int) error {
+	c.mtx.Lock()
+	_, ok := c.blackouts[id]
+	delete(c.blackouts, id)
+	c.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("blackout window not found: %d", id)
+	}
+
+	c.traceInfo("api:", id, ": blackout window removed")
+	return c.saveState()
+}
+
+// A window as returned by the blackouts endpoint.
+type blackoutInfo struct {
+	blackoutDef
+	Source string `json:"source"`
+	Active bool   `json:"active"`
+	Next   string `json:"next,omitempty"` // start of the next window, RFC3339
+}
+
+func (b *blackout) info(t time.Time) *blackoutInfo {
+	info := blackoutInfo{blackoutDef: b.def, Source: b.src, Active: b.active(t)}
+	if next := b.next(t); !next.IsZero() {
+		info.Next = next.Format(time.RFC3339)
+	}
+
+	return &info
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlackoutStartAt(t *testing.T) {
+	utc := func(s string) time.Time {
+		if s == "" {
+			return time.Time{}
+		}
+
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+
+		return t
+	}
+
+	for _, tc := range []struct {
+		line string
+		at   string
+		want string // empty if not within the window
+	}{
+		// Recurring: Fridays 22:00 to Saturdays 02:00.
+		{"duration=4h CRON_TZ=UTC 0 22 * * FRI", "2024-01-05T21:59:59Z", ""},
+		{"duration=4h CRON_TZ=UTC 0 22 * * FRI", "2024-01-05T22:00:00Z", "2024-01-05T22:00:00Z"},
+		{"duration=4h CRON_TZ=UTC 0 22 * * FRI", "2024-01-06T01:59:59Z", "2024-01-05T22:00:00Z"},
+		{"duration=4h CRON_TZ=UTC 0 22 * * FRI", "2024-01-06T02:00:00Z", ""},
+		{"duration=4h CRON_TZ=UTC 0 22 * * FRI", "2024-01-13T00:00:00Z", "2024-01-12T22:00:00Z"},
+
+		// Overlapping windows: the earliest one still active.
+		{"duration=90m CRON_TZ=UTC 0 * * * *", "2024-01-01T10:45:00Z", "2024-01-01T10:00:00Z"},
+		{"duration=90m CRON_TZ=UTC 0 * * * *", "2024-01-01T11:15:00Z", "2024-01-01T10:00:00Z"},
+		{"duration=90m CRON_TZ=UTC 0 * * * *", "2024-01-01T11:30:00Z", "2024-01-01T11:00:00Z"},
+
+		// Time zone of the schedule.
+		{"duration=1h CRON_TZ=Asia/Tokyo 0 9 * * *", "2024-01-01T00:30:00Z", "2024-01-01T00:00:00Z"},
+		{"duration=1h CRON_TZ=Asia/Tokyo 0 9 * * *", "2024-01-01T09:30:00Z", ""},
+
+		// Absolute.
+		{"from=2024-01-10T09:00:00+09:00 to=2024-01-10T18:00:00+09:00", "2024-01-09T23:59:59Z", ""},
+		{"from=2024-01-10T09:00:00+09:00 to=2024-01-10T18:00:00+09:00", "2024-01-10T00:00:00Z", "2024-01-10T00:00:00Z"},
+		{"from=2024-01-10T09:00:00+09:00 to=2024-01-10T18:00:00+09:00", "2024-01-10T08:59:59Z", "2024-01-10T00:00:00Z"},
+		{"from=2024-01-10T09:00:00+09:00 to=2024-01-10T18:00:00+09:00", "2024-01-10T09:00:00Z", ""},
+	} {
+		b, err := parseBlackoutLine(tc.line, defaultJob())
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.line, err)
+			continue
+		}
+
+		got := b.startAt(utc(tc.at))
+		if !got.Equal(utc(tc.want)) {
+			t.Errorf("%q at %s: got %v, want %q", tc.line, tc.at, got, tc.want)
+		}
+
+		if b.active(utc(tc.at)) != (tc.want != "") {
+			t.Errorf("%q at %s: active() doesn't match startAt()", tc.line, tc.at)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Command line quoting rules.
+const (
+	QUOTING_WINDOWS = "windows" // CommandLineToArgvW rules (default)
+	QUOTING_POSIX   = "posix"   // POSIX shell words, without expansions
+)
+
+// Split a command line into its arguments using the 'quoting' rules. There is no limit to the number
+// of arguments.
+func splitCmdLine(s string, quoting string) ([]string, error) {
+	var args []string
+	for {
+		arg, rest, ok, err := nextArg(s, quoting)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return args, nil
+		}
+
+		args = append(args, arg)
+		s = rest
+	}
+}
+
+// Returns the first argument of the command line 's' and the rest of it, unparsed. 'ok' is false if
+// there are no more arguments.
+func nextArg(s string, quoting string) (arg, rest string, ok bool, err error) {
+	s = strings.TrimLeft(s, " \t\r\n")
+	if s == "" {
+		return "", "", false, nil
+	}
+
+	if quoting == QUOTING_POSIX {
+		arg, rest, err = nextPosixArg(s)
+	} else {
+		arg, rest = nextWindowsArg(s)
+	}
+
+	return arg, rest, err == nil, err
+}
+
+// CommandLineToArgvW rules: 2n backslashes and a quote are n backslashes and the quote starts/ends
+// a quoted part, 2n+1 backslashes and a quote are n backslashes and a literal quote, other
+// backslashes are literal. Inside a quoted part, "" is a literal quote that also ends the part.
+func nextWindowsArg(s string) (string, string) {
+	var (
+		b       strings.Builder
+		inQuote bool
+		slashes int
+	)
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			if !inQuote {
+				b.WriteString(strings.Repeat(`\`, slashes))
+				return b.String(), s[i+1:]
+			}
+		case '"':
+			b.WriteString(strings.Repeat(`\`, slashes/2))
+			if slashes%2 == 0 {
+				if inQuote && i+1 < len(s) && s[i+1] == '"' {
+					b.WriteByte('"')
+					i++
+				}
+
+				inQuote = !inQuote
+			} else {
+				b.WriteByte('"')
+			}
+
+			slashes = 0
+			continue
+		case '\\':
+			slashes++
+			continue
+		}
+
+		b.WriteString(strings.Repeat(`\`, slashes))
+		slashes = 0
+		b.WriteByte(c)
+	}
+
+	b.WriteString(strings.Repeat(`\`, slashes))
+	return b.String(), ""
+}
+
+// POSIX shell word rules: a backslash escapes the next character, single quotes keep everything
+// literally, and inside double quotes a backslash only escapes $, `, ", \ and newline. There are no
+// expansions (variables are expanded separately, see expandVars).
+func nextPosixArg(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				if s[i] != '\n' {
+					b.WriteByte(s[i])
+				}
+			}
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return "", "", fmt.Errorf("unterminated single quote")
+			}
+
+			b.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+
+				b.WriteByte(s[i])
+			}
+
+			if !closed {
+				return "", "", fmt.Errorf("unterminated double quote")
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String(), "", nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCmdLineWindows(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want []string
+	}{
+		{``, nil},
+		{`   `, nil},
+		{`a b c`, []string{`a`, `b`, `c`}},
+
+		// Tabs and repeated spaces.
+		{"  a  \t b\t\tc  ", []string{`a`, `b`, `c`}},
+
+		// Quoted parts.
+		{`"C:\Program Files\x" "a b"`, []string{`C:\Program Files\x`, `a b`}},
+		{`"C:\Program Files\x"\y.exe -f`, []string{`C:\Program Files\x\y.exe`, `-f`}},
+		{`a"b c"d`, []string{`ab cd`}},
+		{`"a b`, []string{`a b`}},
+
+		// Empty arguments.
+		{`a "" b`, []string{`a`, ``, `b`}},
+		{`""`, []string{``}},
+		{`"" ""`, []string{``, ``}},
+
+		// "" inside a quoted part is a literal quote that also ends the part.
+		{`"a""b"`, []string{`a"b`}},
+		{`"a""b c"`, []string{`a"b`, `c`}},
+		{`"a """`, []string{`a "`}},
+
+		// Backslashes: 2n before a quote are n and the quote is special, 2n+1 are n and a literal
+		// quote, otherwise literal.
+		{`a\b c\\d`, []string{`a\b`, `c\\d`}},
+		{`a\"b`, []string{`a"b`}},
+		{`a\\"b c"`, []string{`a\b c`}},
+		{`a\\\"b`, []string{`a\"b`}},
+		{`a\\\\"b c"`, []string{`a\\b c`}},
+		{`"a\\" b`, []string{`a\`, `b`}},
+		{`"C:\dir\\" next`, []string{`C:\dir\`, `next`}},
+		{`a\ b\`, []string{`a\`, `b\`}},
+	} {
+		got, err := splitCmdLine(tc.s, QUOTING_WINDOWS)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.s, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestSplitCmdLinePosix(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want []string
+		err  string
+	}{
+		{s: ``},
+		{s: `a b c`, want: []string{`a`, `b`, `c`}},
+		{s: "  a  \t b\t\tc  ", want: []string{`a`, `b`, `c`}},
+
+		// Quotes and escapes.
+		{s: `'a b' "c d"`, want: []string{`a b`, `c d`}},
+		{s: `a'b c'd"e f"`, want: []string{`ab cde f`}},
+		{s: `'a\"b' "a\"b" a\"b`, want: []string{`a\"b`, `a"b`, `a"b`}},
+		{s: `"\$x \a \\"`, want: []string{`$x \a \`}},
+		{s: `a\ b c`, want: []string{`a b`, `c`}},
+		{s: `"it's" 'say "hi"'`, want: []string{`it's`, `say "hi"`}},
+		{s: "a\\\nb", want: []string{`ab`}},
+
+		// Empty arguments.
+		{s: `a '' "" b`, want: []string{`a`, ``, ``, `b`}},
+
+		// Unterminated quotes.
+		{s: `a 'b c`, err: "unterminated single quote"},
+		{s: `a "b c`, err: "unterminated double quote"},
+		{s: `a "b\"`, err: "unterminated double quote"},
+	} {
+		got, err := splitCmdLine(tc.s, QUOTING_POSIX)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: got error %v, want %q", tc.s, err, tc.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.s, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,932 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Misfire policies, i.e. what to do with runs missed while the service was stopped, paused or the
+// system was suspended.
+const (
+	MISFIRE_SKIP = "skip" // forget missed runs (default)
+	MISFIRE_ONCE = "once" // run once on catch-up
+	MISFIRE_ALL  = "all"  // run every missed occurrence, up to 'misfirelimit'
+)
+
+// Fire times at most this old when evaluated are late, not missed: they run whatever the misfire
+// policy. The main loop wakes up at least once a minute, so anything older is a real gap.
+const MISFIRE_GRACE = time.Minute
+
+// Overlap policies, i.e. what to do when a job is due while its previous run is still active.
+const (
+	OVERLAP_ALLOW = "allow" // start another run anyway
+	OVERLAP_SKIP  = "skip"  // don't start this run (default)
+	OVERLAP_QUEUE = "queue" // run once more after the active run finishes
+	OVERLAP_KILL  = "kill"  // kill the active run, then start this one
+)
+
+// Backoff between retries of a failed run.
+const (
+	BACKOFF_FIXED = "fixed" // always 'retrydelay' (default)
+	BACKOFF_EXP   = "exp"   // 'retrydelay' doubled after every attempt, up to an hour
+)
+
+// A single scheduled command line from run.conf.
+type job struct {
+	name         string // optional, needed to be chained by other jobs
+	text         string // the run.conf line itself
+	src          string // file the job is from
+	line         int    // line number in run.conf (position in the list for jobs.json)
+	spec         string // schedule expression
+	sched        schedule
+	args         []string // command line to execute
+	quoting      string   // command line quoting rules; empty is QUOTING_WINDOWS
+	cwd          string   // working directory; empty is the service's
+	env          []string // "KEY=VALUE" items added to the service's environment
+	misfire      string
+	misfireLimit int
+	loc          *time.Location // from CRON_TZ/TZ; nil is local time
+	overlap      string
+	concurrency  int           // maximum active runs with overlap=allow; 0 is no limit
+	timeout      time.Duration // kill the run (and its child processes) after this; 0 is no limit
+	retries      int           // attempts after a failed one
+	retryDelay   time.Duration
+	backoff      string
+	retryCodes   map[int]bool  // exit codes worth a retry; empty is any failure
+	jitter       time.Duration // maximum start delay, spreads the same job across hosts
+	onSuccess    []string      // names of jobs to run after a successful run
+	onFailure    []string      // names of jobs to run after a failed run (all attempts)
+	tags         []string      // for blackout windows
+	order        int           // position in run.conf, for a stable run order
+}
+
+// Parse one run.conf line on top of the defaults in 'def'. Optional 'key=value' job options can be
+// placed before the schedule:
+//
+//	misfire=once CRON_TZ=Asia/Tokyo 0 3 * * * cmd.exe /c cleanup.bat
+//
+// Schedule fields never contain '=' so the first item without it starts the schedule. A line with
+// options only returns a job without a schedule; it sets the defaults for the lines that follow.
+// The items are split one by one, so a 'quoting' option applies to the rest of the line.
+func parseJobLine(s string, def job) (*job, error) {
+	j := def
+	for {
+		item, rest, ok, err := nextArg(s, j.quoting)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return &j, nil
+		}
+
+		if !strings.Contains(item, "=") {
+			break
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if err := j.setOption(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+
+		s = rest
+	}
+
+	items, err := splitCmdLine(s, j.quoting)
+	if err != nil {
+		return nil, err
+	}
+
+	// The schedule is either a macro (@every takes a duration) or 5 to 6 cron fields.
+	n := 5
+	if strings.HasPrefix(items[0], "@") {
+		n = 1
+		if items[0] == "@every" {
+			n = 2
+		}
+	} else if len(items) > 6 {
+		// The seconds field is optional; there are 6 fields if the 6th item is still a valid day of week.
+		if _, _, err := parseCronField(items[5], cronDow); err == nil {
+			n = 6
+		}
+	}
+
+	// Should be at least sched params + a single cmd.
+	if len(items) <= n {
+		return nil, fmt.Errorf("missing schedule or command: %s", s)
+	}
+
+	if err := j.setSchedule(strings.Join(items[:n], " ")); err != nil {
+		return nil, err
+	}
+
+	j.args = items[n:]
+	return &j, nil
+}
+
+// Parse and set the job's schedule; cron expressions use the job's time zone unless they have their
+// own CRON_TZ prefix.
+func (j *job) setSchedule(spec string) error {
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return err
+	}
+
+	if cs, ok := sched.(*cronSchedule); ok && cs.loc == nil {
+		cs.loc = j.loc
+	}
+
+	j.spec = spec
+	j.sched = sched
+	return nil
+}
+
+// Returns the job's location for log messages, i.e. run.conf:12.
+func (j *job) where() string {
+	return fmt.Sprintf("%s:%d", j.src, j.line)
+}
+
+// Identifies the job across run.conf reloads. Runtime state (i.e. active runs) is kept under this.
+func (j *job) id() string {
+	if j.name != "" {
+		return j.name
+	}
+
+	return j.text
+}
+
+// Returns the maximum number of active runs of this job. Only overlap=allow can have more than one.
+func (j *job) maxActive() int {
+	if j.overlap != OVERLAP_ALLOW {
+		return 1
+	}
+
+	return j.concurrency
+}
+
+// Returns true if a failed run is worth another attempt.
+func (j *job) shouldRetry(run *jobRun) bool {
+	if run.attempt > j.retries {
+		return false
+	}
+
+	switch run.status {
+	case RUN_FAILED, RUN_TIMEOUT:
+		return len(j.retryCodes) == 0 || j.retryCodes[run.exitCode]
+	}
+
+	return false
+}
+
+// Returns the delay before the next attempt after a failed 'attempt'.
+func (j *job) retryDelayAfter(attempt int) time.Duration {
+	d := j.retryDelay
+	if j.backoff == BACKOFF_EXP {
+		for i := 1; i < attempt && d < time.Hour; i++ {
+			d *= 2
+		}
+
+		if d > time.Hour {
+			d = time.Hour
+		}
+	}
+
+	return d
+}
+
+// Returns the command line, working directory and environment of a run, with the %VAR% and ${VAR}
+// references expanded.
+func (j *job) command() ([]string, string, []string) {
+	env := mergeEnv(j.env)
+	var args []string
+	for _, arg := range j.args {
+		args = append(args, expandVars(arg, env))
+	}
+
+	return args, expandVars(j.cwd, env), env
+}
+
+// Returns the start delay of the job on this host: between 0 and 'jitter', derived from the host
+// name and the job id so it is different across hosts but the same on every run.
+func (j *job) startDelay() time.Duration {
+	if j.jitter <= 0 {
+		return 0
+	}
+
+	host, _ := os.Hostname()
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(host) + "\x00" + j.id()))
+	return time.Duration(h.Sum64() % uint64(j.jitter))
+}
+
+// Returns true if the job should run only once when the service starts.
+func (j *job) isReboot() bool {
+	_, ok := j.sched.(rebootSchedule)
+	return ok
+}
+
+func (j *job) setOption(key, val string) error {
+	switch key {
+	case "misfire":
+		switch val {
+		case MISFIRE_SKIP, MISFIRE_ONCE, MISFIRE_ALL:
+			j.misfire = val
+		default:
+			return fmt.Errorf("misfire: unknown policy %q (skip, once or all)", val)
+		}
+	case "misfirelimit":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			return fmt.Errorf("misfirelimit: invalid value %q", val)
+		}
+
+		j.misfireLimit = n
+	case "overlap":
+		switch val {
+		case OVERLAP_ALLOW, OVERLAP_SKIP, OVERLAP_QUEUE, OVERLAP_KILL:
+			j.overlap = val
+		default:
+			return fmt.Errorf("overlap: unknown policy %q (allow, skip, queue or kill)", val)
+		}
+	case "concurrency":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return fmt.Errorf("concurrency: invalid value %q", val)
+		}
+
+		j.concurrency = n
+	case "timeout":
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return fmt.Errorf("timeout: invalid duration %q (i.e. 30s, 10m, 1h)", val)
+		}
+
+		j.timeout = d
+	case "retries":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return fmt.Errorf("retries: invalid value %q", val)
+		}
+
+		j.retries = n
+	case "retrydelay":
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return fmt.Errorf("retrydelay: invalid duration %q (i.e. 30s, 10m, 1h)", val)
+		}
+
+		j.retryDelay = d
+	case "backoff":
+		switch val {
+		case BACKOFF_FIXED, BACKOFF_EXP:
+			j.backoff = val
+		default:
+			return fmt.Errorf("backoff: unknown type %q (fixed or exp)", val)
+		}
+	case "retrycodes":
+		j.retryCodes = map[int]bool{}
+		for _, v := range strings.Split(val, ",") {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("retrycodes: invalid exit code %q", v)
+			}
+
+			j.retryCodes[n] = true
+		}
+	case "jitter":
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return fmt.Errorf("jitter: invalid duration %q (i.e. 30s, 10m, 1h)", val)
+		}
+
+		j.jitter = d
+	case "quoting":
+		switch val {
+		case QUOTING_WINDOWS, QUOTING_POSIX:
+			j.quoting = val
+		default:
+			return fmt.Errorf("quoting: unknown rules %q (windows or posix)", val)
+		}
+	case "cwd":
+		if val == "" {
+			return fmt.Errorf("cwd: empty directory")
+		}
+
+		j.cwd = val
+	case "env":
+		if kv := strings.SplitN(val, "=", 2); len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("env: expected env=KEY=VALUE, got %q", val)
+		}
+
+		// Copy, the slice can be shared with the defaults.
+		j.env = append(append([]string{}, j.env...), val)
+	case "name":
+		if val == "" || strings.ContainsAny(val, ", ") {
+			return fmt.Errorf("name: invalid name %q", val)
+		}
+
+		j.name = val
+	case "onsuccess":
+		j.onSuccess = strings.Split(val, ",")
+	case "onfailure":
+		j.onFailure = strings.Split(val, ",")
+	case "tags":
+		j.tags = strings.Split(val, ",")
+		for _, tag := range j.tags {
+			if tag == "" {
+				return fmt.Errorf("tags: invalid value %q", val)
+			}
+		}
+	case "CRON_TZ", "TZ":
+		loc, err := loadCronLocation(val)
+		if err != nil {
+			return err
+		}
+
+		j.loc = loc
+	default:
+		return fmt.Errorf("unknown job option %q", key)
+	}
+
+	return nil
+}
+
+// A parsed run.conf (and jobs.json, run.conf.d): the jobs and the global settings.
+type config struct {
+	jobs      []*job
+	workers   int // maximum number of jobs running at the same time
+	logs      logSettings
+	blackouts []*blackout
+	files     []confText // the files it was read from, in load order
+}
+
+// The content of a config file, kept to save the last applied config.
+type confText struct {
+	Name    string `json:"name"` // i.e. run.conf or run.conf.d\backup.conf
+	Content []byte `json:"content"`
+}
+
+// Job output log settings.
+type logSettings struct {
+	maxSize int64         // start a new file after this many bytes; 0 is no limit
+	maxAge  time.Duration // delete logs older than this; 0 is never
+	gzip    bool          // compress the logs of finished runs
+	quota   int64         // total size of all logs, the oldest are deleted first; 0 is no limit
+}
+
+// Set a global setting. Returns false if 'key' is not one.
+func (cf *config) setGlobal(key, val string) (bool, error) {
+	switch key {
+	case "workers":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			return true, fmt.Errorf("workers: invalid value %q", val)
+		}
+
+		cf.workers = n
+	case "logmaxsize", "logquota":
+		n, err := parseSize(val)
+		if err != nil {
+			return true, fmt.Errorf("%s: %v", key, err)
+		}
+
+		if key == "logmaxsize" {
+			cf.logs.maxSize = n
+		} else {
+			cf.logs.quota = n
+		}
+	case "logmaxage":
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return true, fmt.Errorf("logmaxage: invalid duration %q (i.e. 72h)", val)
+		}
+
+		cf.logs.maxAge = d
+	case "loggzip":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return true, fmt.Errorf("loggzip: invalid value %q (true or false)", val)
+		}
+
+		cf.logs.gzip = b
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Parse a size in bytes with an optional KB, MB or GB suffix (i.e. 10MB).
+func parseSize(s string) (int64, error) {
+	mul := int64(1)
+	num := strings.ToUpper(s)
+	for _, u := range []struct {
+		suffix string
+		mul    int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mul = strings.TrimSuffix(num, u.suffix), u.mul
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (i.e. 512KB, 10MB, 1GB)", s)
+	}
+
+	return n * mul, nil
+}
+
+func confFile() string {
+	path, _ := getModuleFileName()
+	dir, _ := filepath.Abs(filepath.Dir(path))
+	return dir + `\run.conf`
+}
+
+func jobsFile() string {
+	return filepath.Dir(confFile()) + `\jobs.json`
+}
+
+// Folder of config fragments, owned by different teams for example.
+func confDir() string {
+	return filepath.Dir(confFile()) + `\run.conf.d`
+}
+
+// A config file to load.
+type confSource struct {
+	path string
+	name string // tag of its jobs and errors, i.e. run.conf.d\backup.conf
+}
+
+// Returns true for the file names allowed in run.conf.d: *.conf (run.conf syntax) and *.json
+// (jobs.json syntax), without path.
+func isFragmentName(name string) bool {
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `\/:`) {
+		return false
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".conf", ".json":
+		return true
+	}
+
+	return false
+}
+
+// Returns the config files to load, in order: run.conf, jobs.json, then the fragments in run.conf.d
+// sorted by name. Missing files are left out.
+func confSources() ([]confSource, error) {
+	var srcs []confSource
+	for _, path := range []string{confFile(), jobsFile()} {
+		if _, err := os.Stat(path); err == nil {
+			srcs = append(srcs, confSource{path: path, name: filepath.Base(path)})
+		}
+	}
+
+	fis, err := ioutil.ReadDir(confDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+
+		return srcs, err
+	}
+
+	var names []string
+	for _, fi := range fis {
+		if !fi.IsDir() && isFragmentName(fi.Name()) {
+			names = append(names, fi.Name())
+		}
+	}
+
+	sort.Slice(names, func(i, k int) bool { return strings.ToLower(names[i]) < strings.ToLower(names[k]) })
+	for _, name := range names {
+		srcs = append(srcs, confSource{path: confDir() + `\` + name, name: `run.conf.d\` + name})
+	}
+
+	return srcs, nil
+}
+
+// Read and parse run.conf, jobs.json and the fragments in run.conf.d from the service's folder. Any
+// one of them is enough; the jobs are merged in the order of confSources. Option-only lines (job
+// defaults) apply to the rest of their own file only.
+func readConf() (*config, []error) {
+	return readConfWith("", nil)
+}
+
+// Same as readConf but with the content of the file 'name' (i.e. run.conf or run.conf.d\backup.conf)
+// replaced by, or added as, 'b'. Used to check a file before it is uploaded.
+func readConfWith(name string, b []byte) (*config, []error) {
+	var errs []error
+	srcs, err := confSources()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if name != "" {
+		found := false
+		for _, src := range srcs {
+			found = found || src.name == name
+		}
+
+		if !found {
+			srcs = append(srcs, confSource{name: name})
+			sort.SliceStable(srcs, func(i, k int) bool { return srcs[i].before(srcs[k]) })
+		}
+	}
+
+	if len(srcs) == 0 {
+		errs = append(errs, fmt.Errorf("no run.conf, jobs.json or run.conf.d in %s", filepath.Dir(confFile())))
+	}
+
+	var files []confText
+	for _, src := range srcs {
+		if src.name == name {
+			files = append(files, confText{Name: name, Content: b})
+			continue
+		}
+
+		content, err := ioutil.ReadFile(src.path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		files = append(files, confText{Name: src.name, Content: content})
+	}
+
+	cf, perrs := parseConfFiles(files)
+	return cf, append(errs, perrs...)
+}
+
+// Parse the content of config files, in load order.
+func parseConfFiles(files []confText) (*config, []error) {
+	var errs []error
+	cf := newConfig()
+	cf.files = files
+	for _, f := range files {
+		workers, logs := cf.workers, cf.logs
+		if strings.ToLower(filepath.Ext(f.Name)) == ".json" {
+			errs = append(errs, cf.parseJSON(f.Name, f.Content)...)
+		} else {
+			errs = append(errs, cf.parseLines(f.Name, strings.Split(string(f.Content), "\n"))...)
+		}
+
+		if strings.HasPrefix(f.Name, `run.conf.d\`) && (cf.workers != workers || cf.logs != logs) {
+			errs = append(errs, fmt.Errorf("%s: global settings can only be set in run.conf or jobs.json", f.Name))
+			cf.workers, cf.logs = workers, logs
+		}
+	}
+
+	return cf, append(errs, cf.check()...)
+}
+
+// Load order: run.conf, jobs.json, then the fragments by name.
+func (s confSource) before(o confSource) bool {
+	rank := func(name string) int {
+		switch name {
+		case "run.conf":
+			return 0
+		case "jobs.json":
+			return 1
+		}
+
+		return 2
+	}
+
+	if rank(s.name) != rank(o.name) {
+		return rank(s.name) < rank(o.name)
+	}
+
+	return strings.ToLower(s.name) < strings.ToLower(o.name)
+}
+
+// Returns the earliest fire time of all jobs after 't', but not later than the next wall clock minute.
+func (cf *config) nextWake(t time.Time) time.Time {
+	wake := t.Truncate(time.Minute).Add(time.Minute)
+	for _, j := range cf.jobs {
+		if next := j.sched.next(t); !next.IsZero() && next.Before(wake) {
+			wake = next
+		}
+	}
+
+	return wake
+}
+
+func newConfig() *config {
+	return &config{
+		workers: 4,
+		logs:    logSettings{maxSize: 10 << 20, maxAge: 30 * 24 * time.Hour, quota: 1 << 30},
+	}
+}
+
+// Returns a job with the default options.
+func defaultJob() job {
+	return job{
+		misfire:      MISFIRE_SKIP,
+		misfireLimit: 10,
+		overlap:      OVERLAP_SKIP,
+		retryDelay:   30 * time.Second,
+		backoff:      BACKOFF_FIXED,
+	}
+}
+
+// Parse run.conf style lines from file 'src' and add the jobs to the config. Blank lines and comments
+// are skipped. Lines with errors are returned with their line numbers; the config is only applied if
+// there are none. A line with options only sets the job defaults for the lines after it, and can also
+// hold the global settings (run.conf only):
+//
+//	workers=4         maximum number of jobs running at the same time
+//	logmaxsize=10MB   start a new job output log file after this size
+//	logmaxage=720h    delete job output logs older than this
+//	loggzip=false     compress the output logs of finished runs
+//	logquota=1GB      total size of all job output logs
+func (cf *config) parseLines(src string, lines []string) []error {
+	var errs []error
+	def := defaultJob()
+	for n, str := range lines {
+		s := strings.TrimSpace(str)
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		var (
+			j   *job
+			err error
+		)
+
+		if item, rest, _, _ := nextArg(s, def.quoting); item == "@blackout" {
+			b, err := parseBlackoutLine(rest, def)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: @blackout: %v", src, n+1, err))
+				continue
+			}
+
+			b.src = fmt.Sprintf("%s:%d", src, n+1)
+			cf.blackouts = append(cf.blackouts, b)
+			continue
+		}
+
+		if isOptionLine(s, def.quoting) {
+			j, err = parseSettingsLine(s, def, cf)
+		} else {
+			j, err = parseJobLine(s, def)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", src, n+1, err))
+			continue
+		}
+
+		if j.sched == nil {
+			if j.name != "" {
+				errs = append(errs, fmt.Errorf("%s:%d: name cannot be a default", src, n+1))
+				continue
+			}
+
+			def = *j
+			continue
+		}
+
+		j.text = s
+		j.src = src
+		j.line = n + 1
+		cf.jobs = append(cf.jobs, j)
+	}
+
+	return errs
+}
+
+// Validate the whole job table once all the files are parsed.
+func (cf *config) check() []error {
+	errs := cf.checkChains()
+	for i, j := range cf.jobs {
+		j.order = i
+	}
+
+	return errs
+}
+
+// Returns the job named 'name', or nil if there is none.
+func (cf *config) job(name string) *job {
+	for _, j := range cf.jobs {
+		if j.name != "" && j.name == name {
+			return j
+		}
+	}
+
+	return nil
+}
+
+// Returns the job with the id (name or run.conf line) or location (i.e. run.conf:12) 'id', or nil.
+func (cf *config) jobByID(id string) *job {
+	for _, j := range cf.jobs {
+		if j.id() == id {
+			return j
+		}
+	}
+
+	for _, j := range cf.jobs {
+		if j.where() == id {
+			return j
+		}
+	}
+
+	return nil
+}
+
+// Validate the onsuccess/onfailure chains. Jobs with duplicate names, chained to unknown jobs or part
+// of a cycle are removed from the config.
+func (cf *config) checkChains() []error {
+	var errs []error
+	drop := func(j *job, err error) {
+		errs = append(errs, fmt.Errorf("%s: %v", j.where(), err))
+		for i, v := range cf.jobs {
+			if v == j {
+				cf.jobs = append(cf.jobs[:i], cf.jobs[i+1:]...)
+				break
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, j := range append([]*job{}, cf.jobs...) {
+		if j.name != "" && seen[j.name] {
+			drop(j, fmt.Errorf("duplicate job name %q", j.name))
+			continue
+		}
+
+		seen[j.name] = true
+	}
+
+	// Dropping a job can break the chains of others, so repeat until nothing changes.
+	for changed := true; changed; {
+		changed = false
+		for _, j := range append([]*job{}, cf.jobs...) {
+			for _, name := range append(append([]string{}, j.onSuccess...), j.onFailure...) {
+				if cf.job(name) == nil {
+					drop(j, fmt.Errorf("chained to unknown job %q", name))
+					changed = true
+					break
+				}
+			}
+		}
+
+		if cycle := cf.findCycle(); cycle != nil {
+			var names []string
+			for _, j := range cycle {
+				names = append(names, j.name)
+			}
+
+			names = append(names, names[0])
+			for _, j := range cycle {
+				drop(j, fmt.Errorf("chain cycle: %s", strings.Join(names, " -> ")))
+			}
+
+			changed = true
+		}
+	}
+
+	return errs
+}
+
+// Returns the jobs of the first chain cycle found, or nil if there is none.
+func (cf *config) findCycle() []*job {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := map[*job]int{}
+	var path []*job
+	var visit func(j *job) []*job
+	visit = func(j *job) []*job {
+		state[j] = visiting
+		path = append(path, j)
+		for _, name := range append(append([]string{}, j.onSuccess...), j.onFailure...) {
+			next := cf.job(name)
+			if next == nil {
+				continue
+			}
+
+			switch state[next] {
+			case visiting:
+				for i, v := range path {
+					if v == next {
+						return append([]*job{}, path[i:]...)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[j] = visited
+		return nil
+	}
+
+	for _, j := range cf.jobs {
+		if state[j] == unvisited {
+			if cycle := visit(j); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the line only has 'key=value' items.
+func isOptionLine(s string, quoting string) bool {
+	items, err := splitCmdLine(s, quoting)
+	if err != nil {
+		return false
+	}
+
+	for _, item := range items {
+		if !strings.Contains(item, "=") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Parse an option-only line, which can also have global settings. Returns the new job defaults.
+func parseSettingsLine(s string, def job, cf *config) (*job, error) {
+	j := def
+	for {
+		item, rest, ok, err := nextArg(s, j.quoting)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return &j, nil
+		}
+
+		s = rest
+		kv := strings.SplitN(item, "=", 2)
+		if ok, err := cf.setGlobal(kv[0], kv[1]); ok {
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if err := j.setOption(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Returns the fire times the job should run for in the evaluation window ('from', 'now'], based on
+// its misfire policy. Fire times older than MISFIRE_GRACE are the ones missed.
+func (j *job) dueTimes(from, now time.Time) []time.Time {
+	late := now.Add(-MISFIRE_GRACE)
+	// Missed runs don't matter when skipped.
+	if j.misfire == MISFIRE_SKIP && from.Before(late) {
+		from = late
+	}
+
+	var missed, onTime []time.Time
+	for t := j.sched.next(from); !t.IsZero() && !t.After(now); t = j.sched.next(t) {
+		if t.After(late) {
+			onTime = append(onTime, t)
+			continue
+		}
+
+		missed = append(missed, t)
+		// Only the most recent ones are kept.
+		if len(missed) > j.misfireLimit {
+			missed = missed[1:]
+		}
+	}
+
+	var due []time.Time
+	if len(missed) > 0 {
+		switch j.misfire {
+		case MISFIRE_ONCE:
+			if len(onTime) == 0 {
+				due = append(due, missed[len(missed)-1])
+			}
+		case MISFIRE_ALL:
+			due = append(due, missed...)
+		}
+	}
+
+	return append(due, onTime...)
+}
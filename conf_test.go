@@ -0,0 +1,195 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseJobLineFields(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		spec string
+		args []string
+	}{
+		{"*/5 * * * * cmd.exe /c x.bat", "*/5 * * * *", []string{"cmd.exe", "/c", "x.bat"}},
+		{"30 */5 * * * * cmd.exe /c x.bat", "30 */5 * * * *", []string{"cmd.exe", "/c", "x.bat"}},
+		{"0 0 * * MON-FRI cmd.exe", "0 0 * * MON-FRI", []string{"cmd.exe"}},
+
+		// The 6th item is a valid day of week: a seconds field.
+		{"0 0 8 * * 1 cmd.exe", "0 0 8 * * 1", []string{"cmd.exe"}},
+		{"0 0 8 * * 1 5", "0 0 8 * * 1", []string{"5"}},
+
+		// A single item after 5 fields is the command.
+		{"0 8 * * 1 5", "0 8 * * 1", []string{"5"}},
+
+		// Macros and options.
+		{"@hourly cmd.exe", "@hourly", []string{"cmd.exe"}},
+		{"@every 90s cmd.exe /c x.bat", "@every 90s", []string{"cmd.exe", "/c", "x.bat"}},
+		{"CRON_TZ=Asia/Tokyo 0 3 * * * cmd.exe", "0 3 * * *", []string{"cmd.exe"}},
+	} {
+		j, err := parseJobLine(tc.line, defaultJob())
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.line, err)
+			continue
+		}
+
+		if j.spec != tc.spec || !reflect.DeepEqual(j.args, tc.args) {
+			t.Errorf("%q: got %q %q, want %q %q", tc.line, j.spec, j.args, tc.spec, tc.args)
+		}
+	}
+}
+
+func TestDueTimes(t *testing.T) {
+	utc := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+
+		return t
+	}
+
+	for _, tc := range []struct {
+		line string
+		from string
+		now  string
+		want []string
+	}{
+		// On time.
+		{"* * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T10:01:00Z", []string{"2024-01-01T10:01:00Z"}},
+		{"*/10 * * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T10:00:10Z", []string{"2024-01-01T10:00:10Z"}},
+		{"0 * * * * x", "2024-01-01T10:30:00Z", "2024-01-01T10:31:00Z", nil},
+
+		// Woken up late: still due, whatever the misfire policy.
+		{"* * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T10:01:02Z", []string{"2024-01-01T10:01:00Z"}},
+		{"misfire=once * * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T10:01:59Z", []string{"2024-01-01T10:01:00Z"}},
+		{"*/10 * * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T10:00:25Z", []string{"2024-01-01T10:00:10Z", "2024-01-01T10:00:20Z"}},
+
+		// A minute or more late: missed.
+		{"* * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T10:02:30Z", []string{"2024-01-01T10:02:00Z"}},
+		{"0 * * * * x", "2024-01-01T10:30:00Z", "2024-01-01T11:01:00Z", nil},
+
+		// misfire=skip (default): only the on time one.
+		{"0 * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T13:00:00Z", []string{"2024-01-01T13:00:00Z"}},
+		{"0 * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T13:30:00Z", nil},
+
+		// misfire=once: the last missed one, unless one is on time.
+		{"misfire=once 0 * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T13:30:00Z", []string{"2024-01-01T13:00:00Z"}},
+		{"misfire=once 0 * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T13:00:00Z", []string{"2024-01-01T13:00:00Z"}},
+		{"misfire=once 0 * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T10:30:00Z", nil},
+
+		// misfire=all: every missed one, up to misfirelimit most recent ones.
+		{"misfire=all 0 * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T13:30:00Z", []string{"2024-01-01T11:00:00Z", "2024-01-01T12:00:00Z", "2024-01-01T13:00:00Z"}},
+		{"misfire=all 0 * * * * x", "2024-01-01T10:00:00Z", "2024-01-01T13:00:00Z", []string{"2024-01-01T11:00:00Z", "2024-01-01T12:00:00Z", "2024-01-01T13:00:00Z"}},
+		{"misfire=all misfirelimit=2 0 * * * * x", "2024-01-01T00:00:00Z", "2024-01-01T05:30:00Z", []string{"2024-01-01T04:00:00Z", "2024-01-01T05:00:00Z"}},
+		{"misfire=all misfirelimit=2 0 * * * * x", "2024-01-01T00:00:00Z", "2024-01-01T05:00:00Z", []string{"2024-01-01T03:00:00Z", "2024-01-01T04:00:00Z", "2024-01-01T05:00:00Z"}},
+
+		// Never due.
+		{"misfire=all @manual x", "2024-01-01T00:00:00Z", "2024-01-01T05:00:00Z", nil},
+	} {
+		j, err := parseJobLine("TZ=UTC "+tc.line, defaultJob())
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.line, err)
+			continue
+		}
+
+		got := j.dueTimes(utc(tc.from), utc(tc.now))
+		if len(got) != len(tc.want) {
+			t.Errorf("%q (%s, %s]: got %v, want %v", tc.line, tc.from, tc.now, got, tc.want)
+			continue
+		}
+
+		for i, want := range tc.want {
+			if !got[i].Equal(utc(want)) {
+				t.Errorf("%q (%s, %s]: got %v, want %v", tc.line, tc.from, tc.now, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCheckChains(t *testing.T) {
+	for _, tc := range []struct {
+		conf string
+		jobs []string // names of the jobs kept
+		errs []string
+	}{
+		// Valid chains.
+		{"name=a onsuccess=b 0 * * * * x\nname=b onfailure=c @manual x\nname=c @manual x", []string{"a", "b", "c"}, nil},
+		{"name=a onsuccess=b,c 0 * * * * x\nname=b onsuccess=c @manual x\nname=c @manual x", []string{"a", "b", "c"}, nil},
+
+		// Duplicate names: the later one is dropped.
+		{"name=a 0 * * * * x\nname=a 5 * * * * x", []string{"a"}, []string{`run.conf:2: duplicate job name "a"`}},
+
+		// Unknown targets, also the ones dropped.
+		{"name=a onsuccess=x 0 * * * * x\nname=b 0 * * * * x", []string{"b"}, []string{`run.conf:1: chained to unknown job "x"`}},
+		{"name=a onsuccess=b 0 * * * * x\nname=b onfailure=x @manual x", nil, []string{
+			`run.conf:2: chained to unknown job "x"`,
+			`run.conf:1: chained to unknown job "b"`,
+		}},
+
+		// Cycles.
+		{"name=a onsuccess=a 0 * * * * x\nname=b 0 * * * * x", []string{"b"}, []string{"run.conf:1: chain cycle: a -> a"}},
+		{"name=a onsuccess=b 0 * * * * x\nname=b onfailure=a @manual x\nname=c onsuccess=a 0 * * * * x\nname=d 0 * * * * x", []string{"d"}, []string{
+			"run.conf:1: chain cycle: a -> b -> a",
+			"run.conf:2: chain cycle: a -> b -> a",
+			`run.conf:3: chained to unknown job "a"`,
+		}},
+	} {
+		cf, errs := parseConfFiles([]confText{{Name: "run.conf", Content: []byte(tc.conf)}})
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+
+		if !reflect.DeepEqual(got, tc.errs) {
+			t.Errorf("%q: got errors %q, want %q", tc.conf, got, tc.errs)
+		}
+
+		var names []string
+		for _, j := range cf.jobs {
+			names = append(names, j.name)
+		}
+
+		if !reflect.DeepEqual(names, tc.jobs) {
+			t.Errorf("%q: got jobs %q, want %q", tc.conf, names, tc.jobs)
+		}
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	for _, tc := range []struct {
+		chains string // name:onsuccess targets, space separated
+		want   string // cycle, empty if none
+	}{
+		{"a:b b:c c:", ""},
+		{"a:b,c b:c c:", ""},
+		{"a:a", "a"},
+		{"a:b b:a", "a b"},
+		{"x: a:b b:c c:a", "a b c"},
+		{"a:b b:c c:b", "b c"},
+		{"a:x b:a", ""}, // unknown targets are not followed
+	} {
+		var cf config
+		for _, item := range strings.Fields(tc.chains) {
+			kv := strings.SplitN(item, ":", 2)
+			j := &job{name: kv[0]}
+			if kv[1] != "" {
+				j.onSuccess = strings.Split(kv[1], ",")
+			}
+
+			cf.jobs = append(cf.jobs, j)
+		}
+
+		var names []string
+		for _, j := range cf.findCycle() {
+			names = append(names, j.name)
+		}
+
+		if got := strings.Join(names, " "); got != tc.want {
+			t.Errorf("%q: got cycle %q, want %q", tc.chains, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // embedded tz database for CRON_TZ, not always available on Windows
+)
+
+// A single cron field's bounds and optional names (month and day of week).
+type cronBounds struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	cronSecond = cronBounds{name: "second", min: 0, max: 59}
+	cronMinute = cronBounds{name: "minute", min: 0, max: 59}
+	cronHour   = cronBounds{name: "hour", min: 0, max: 23}
+	cronDom    = cronBounds{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronBounds{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+
+	// 7 is accepted as an alias of Sunday (0).
+	cronDow = cronBounds{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// A parsed cron schedule. Each field is a bit set of the allowed values.
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	domStar, dowStar                      bool           // field is unrestricted ('*' or '*/n')
+	wildcard                              bool           // second, minute or hour field starts with '*'
+	loc                                   *time.Location // time zone of the fields; nil is local time
+}
+
+// A schedule computes its own fire times.
+type schedule interface {
+	// Returns the first fire time after 't', or the zero time if there is none.
+	next(t time.Time) time.Time
+
+	// Returns the normalized expression.
+	String() string
+}
+
+// Fires every fixed interval, aligned to multiples of the interval (not to service start) so runs
+// line up across restarts and systems.
+type everySchedule struct {
+	d time.Duration
+}
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Truncate(s.d).Add(s.d)
+}
+
+func (s everySchedule) String() string {
+	return "@every " + s.d.String()
+}
+
+// Fires only once when the service starts.
+type rebootSchedule struct{}
+
+func (s rebootSchedule) next(t time.Time) time.Time {
+	return time.Time{}
+}
+
+func (s rebootSchedule) String() string {
+	return "@reboot"
+}
+
+// Never fires by itself; the job only runs when triggered (i.e. by another job's onsuccess/onfailure).
+type manualSchedule struct{}
+
+func (s manualSchedule) next(t time.Time) time.Time {
+	return time.Time{}
+}
+
+func (s manualSchedule) String() string {
+	return "@manual"
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse a schedule expression; either a cron expression (see parseCron) or one of the macros @yearly
+// (@annually), @monthly, @weekly, @daily (@midnight), @hourly, '@every <duration>' (i.e. @every 90s),
+// @reboot and @manual. The expression can be prefixed with 'CRON_TZ=<zone>' (or 'TZ=<zone>') to evaluate it
+// in a time zone other than local time.
+func parseSchedule(spec string) (schedule, error) {
+	var loc *time.Location
+	fields := strings.Fields(spec)
+	if len(fields) > 0 && strings.Contains(fields[0], "=") {
+		kv := strings.SplitN(fields[0], "=", 2)
+		if kv[0] != "CRON_TZ" && kv[0] != "TZ" {
+			return nil, fmt.Errorf("unknown prefix %q", fields[0])
+		}
+
+		l, err := loadCronLocation(kv[1])
+		if err != nil {
+			return nil, err
+		}
+
+		loc = l
+		fields = fields[1:]
+	}
+
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		switch fields[0] {
+		case "@reboot":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("@reboot takes no arguments")
+			}
+
+			return rebootSchedule{}, nil
+		case "@manual":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("@manual takes no arguments")
+			}
+
+			return manualSchedule{}, nil
+		case "@every":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("@every expects a duration, i.e. @every 90s")
+			}
+
+			d, err := time.ParseDuration(fields[1])
+			if err != nil || d < time.Second {
+				return nil, fmt.Errorf("@every: invalid duration %q (1s minimum)", fields[1])
+			}
+
+			return everySchedule{d: d.Truncate(time.Second)}, nil
+		}
+
+		expr, ok := cronMacros[fields[0]]
+		if !ok || len(fields) != 1 {
+			return nil, fmt.Errorf("unknown macro %q", strings.Join(fields, " "))
+		}
+
+		fields = strings.Fields(expr)
+	}
+
+	s, err := parseCron(strings.Join(fields, " "))
+	if err != nil {
+		return nil, err
+	}
+
+	s.loc = loc
+	return s, nil
+}
+
+// Parse a standard 5-field (Vixie) cron expression: minute, hour, day of month, month, day of week.
+// An optional seconds field can be added in front (6 fields) for sub-minute schedules; without it,
+// the schedule fires at second 0. Each field accepts '*', numbers, names (month and day of week
+// only), ranges 'a-b', lists 'a,b,c' and steps '*/n' or 'a-b/n'.
+func parseCron(spec string) (*cronSchedule, error) {
+	var (
+		s   cronSchedule
+		err error
+	)
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		s.second = 1
+	case 6:
+		if s.second, s.wildcard, err = parseCronField(fields[0], cronSecond); err != nil {
+			return nil, err
+		}
+
+		fields = fields[1:]
+	default:
+		return nil, fmt.Errorf("expected 5 or 6 fields, found %d: %q", len(fields), spec)
+	}
+
+	var minuteStar, hourStar bool
+	if s.minute, minuteStar, err = parseCronField(fields[0], cronMinute); err != nil {
+		return nil, err
+	}
+
+	if s.hour, hourStar, err = parseCronField(fields[1], cronHour); err != nil {
+		return nil, err
+	}
+
+	s.wildcard = s.wildcard || minuteStar || hourStar
+
+	if s.dom, s.domStar, err = parseCronField(fields[2], cronDom); err != nil {
+		return nil, err
+	}
+
+	if s.month, _, err = parseCronField(fields[3], cronMonth); err != nil {
+		return nil, err
+	}
+
+	if s.dow, s.dowStar, err = parseCronField(fields[4], cronDow); err != nil {
+		return nil, err
+	}
+
+	// Fold 7 (Sunday) into 0.
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+
+	return &s, nil
+}
+
+// Parse one comma-separated field into a bit set. The second return value is true when the
+// field starts with '*'.
+func parseCronField(field string, b cronBounds) (uint64, bool, error) {
+	var bits uint64
+	star := strings.HasPrefix(field, "*")
+	for _, item := range strings.Split(field, ",") {
+		v, err := parseCronRange(item, b)
+		if err != nil {
+			return 0, false, err
+		}
+
+		bits |= v
+	}
+
+	return bits, star, nil
+}
+
+// Parse a single list item: '*', 'n', 'a-b', each with an optional '/step'.
+func parseCronRange(item string, b cronBounds) (uint64, error) {
+	if item == "" {
+		return 0, fmt.Errorf("%s: empty item", b.name)
+	}
+
+	var (
+		lo, hi int
+		step   = 1
+		err    error
+	)
+
+	rng := item
+	if i := strings.Index(item, "/"); i >= 0 {
+		rng = item[:i]
+		step, err = strconv.Atoi(item[i+1:])
+		if err != nil || step <= 0 {
+			return 0, fmt.Errorf("%s: invalid step in %q", b.name, item)
+		}
+	}
+
+	switch {
+	case rng == "*":
+		lo, hi = b.min, b.max
+		if b.max == 7 {
+			hi = 6 // '*' in day of week shouldn't double count Sunday
+		}
+	case strings.Contains(rng, "-"):
+		parts := strings.SplitN(rng, "-", 2)
+		if lo, err = parseCronValue(parts[0], b); err != nil {
+			return 0, err
+		}
+
+		if hi, err = parseCronValue(parts[1], b); err != nil {
+			return 0, err
+		}
+
+		if lo > hi {
+			return 0, fmt.Errorf("%s: invalid range %q", b.name, rng)
+		}
+	default:
+		if lo, err = parseCronValue(rng, b); err != nil {
+			return 0, err
+		}
+
+		hi = lo
+		// 'n/step' means 'n-max/step'.
+		if strings.Contains(item, "/") {
+			hi = b.max
+		}
+	}
+
+	var bits uint64
+	for i := lo; i <= hi; i += step {
+		bits |= 1 << uint(i)
+	}
+
+	return bits, nil
+}
+
+// Returns the schedule as 6 fields (with seconds), with its CRON_TZ prefix if any. Macros and names
+// are expanded, i.e. '@weekly' is '0 0 0 * * 0' and 'MON-FRI' is '1-5'.
+func (s *cronSchedule) String() string {
+	fields := []string{
+		formatCronField(s.second, cronSecond, true),
+		formatCronField(s.minute, cronMinute, true),
+		formatCronField(s.hour, cronHour, true),
+		formatCronField(s.dom, cronDom, s.domStar),
+		formatCronField(s.month, cronMonth, true),
+		formatCronField(s.dow, cronDow, s.dowStar),
+	}
+
+	spec := strings.Join(fields, " ")
+	if s.loc != nil {
+		spec = "CRON_TZ=" + s.loc.String() + " " + spec
+	}
+
+	return spec
+}
+
+// Format a field's bit set as '*', '*/n', 'a-b/n' or a list of values and ranges. 'star' is false
+// if '*' would change the meaning of the field (day of month and day of week).
+func formatCronField(bits uint64, b cronBounds, star bool) string {
+	lo, hi := b.min, b.max
+	if b.max == 7 {
+		hi = 6 // Sunday is always 0
+	}
+
+	var vals []int
+	for i := lo; i <= hi; i++ {
+		if bits&(1<<uint(i)) != 0 {
+			vals = append(vals, i)
+		}
+	}
+
+	if star && len(vals) == hi-lo+1 {
+		return "*"
+	}
+
+	// Evenly spaced values are a step; '*/n' if they span the whole range.
+	if len(vals) > 2 && vals[1]-vals[0] > 1 {
+		step := vals[1] - vals[0]
+		even := true
+		for i := 2; i < len(vals); i++ {
+			even = even && vals[i]-vals[i-1] == step
+		}
+
+		last := vals[len(vals)-1]
+		if even {
+			if star && vals[0] == lo && last+step > hi {
+				return fmt.Sprintf("*/%d", step)
+			}
+
+			return fmt.Sprintf("%d-%d/%d", vals[0], last, step)
+		}
+	}
+
+	var items []string
+	for i := 0; i < len(vals); {
+		k := i
+		for k+1 < len(vals) && vals[k+1] == vals[k]+1 {
+			k++
+		}
+
+		if k-i >= 2 {
+			items = append(items, fmt.Sprintf("%d-%d", vals[i], vals[k]))
+		} else {
+			for ; i <= k; i++ {
+				items = append(items, strconv.Itoa(vals[i]))
+			}
+		}
+
+		i = k + 1
+	}
+
+	return strings.Join(items, ",")
+}
+
+func loadCronLocation(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+
+	return loc, nil
+}
+
+func parseCronValue(s string, b cronBounds) (int, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid value %q", b.name, s)
+	}
+
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("%s: value %d out of range (%d-%d)", b.name, v, b.min, b.max)
+	}
+
+	return v, nil
+}
+
+// When both day of month and day of week are restricted, either one matching is enough (same as
+// Vixie cron).
+func (s *cronSchedule) dayMatch(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+func (s *cronSchedule) location() *time.Location {
+	if s.loc == nil {
+		return time.Local
+	}
+
+	return s.loc
+}
+
+// Returns the first fire time after 't', or the zero time if there is none within the next five
+// years (i.e. Feb 30). Fields are matched against the wall clock of the schedule's time zone. On DST
+// transitions, a skipped wall clock time fires once at the end of the gap. A repeated wall clock time
+// fires on both occurrences, unless the schedule is at fixed times (no '*' in the second, minute and
+// hour fields) where it fires only on the first one (same as Vixie cron).
+func (s *cronSchedule) next(t time.Time) time.Time {
+	loc := s.location()
+	lt := t.In(loc)
+	at := s.nextAfter(t, wallClock(lt), loc)
+	if !s.wildcard {
+		return at
+	}
+
+	// The wall clock goes back when the current zone ends (fall back); the repeated times after it
+	// may come before 'at'.
+	if _, end := lt.ZoneBounds(); !end.IsZero() && (at.IsZero() || at.After(end)) {
+		again := s.nextAfter(t, wallClock(end.In(loc)).Add(-time.Second), loc)
+		if !again.IsZero() && (at.IsZero() || again.Before(at)) {
+			return again
+		}
+	}
+
+	return at
+}
+
+// Returns the first fire time after 't' of the wall clock times after 'wall'.
+func (s *cronSchedule) nextAfter(t, wall time.Time, loc *time.Location) time.Time {
+	for {
+		wall = s.nextWall(wall)
+		if wall.IsZero() {
+			return wall
+		}
+
+		at, again := resolveWall(wall, loc)
+		if at.After(t) {
+			return at
+		}
+
+		if s.wildcard && !again.IsZero() && again.After(t) {
+			return again
+		}
+	}
+}
+
+// Same as next() but on a wall clock time (in UTC, i.e. no DST).
+func (s *cronSchedule) nextWall(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second()+1, 0, loc)
+	limit := t.Year() + 5
+
+wrap:
+	if t.Year() > limit {
+		return time.Time{}
+	}
+
+	for s.month&(1<<uint(t.Month())) == 0 {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !s.dayMatch(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for s.hour&(1<<uint(t.Hour())) == 0 {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+
+	for s.minute&(1<<uint(t.Minute())) == 0 {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+
+	for s.second&(1<<uint(t.Second())) == 0 {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second()+1, 0, loc)
+		if t.Second() == 0 {
+			goto wrap
+		}
+	}
+
+	return t
+}
+
+// Convert a wall clock time (in UTC) to the actual time in 'loc'. A wall clock time skipped by a DST
+// transition resolves to the end of the gap; a repeated one resolves to its first occurrence, with
+// the second one returned as well.
+func resolveWall(w time.Time, loc *time.Location) (time.Time, time.Time) {
+	t := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, loc)
+	if !sameWall(t, w) {
+		// Go normalizes a skipped time using either side's offset.
+		start, end := t.ZoneBounds()
+		if wallBefore(t, w) {
+			return end, time.Time{}
+		}
+
+		return start, time.Time{}
+	}
+
+	// If the offset in effect before this zone started (or after it ends) also yields the same wall
+	// clock time, it's a repeated time; Go may return either occurrence.
+	start, end := t.ZoneBounds()
+	if !start.IsZero() {
+		_, off := start.Add(-time.Second).Zone()
+		alt := time.Unix(w.Unix()-int64(off), 0).In(loc)
+		if alt.Before(start) && sameWall(alt, w) {
+			return alt, t
+		}
+	}
+
+	if !end.IsZero() {
+		_, off := end.Zone()
+		alt := time.Unix(w.Unix()-int64(off), 0).In(loc)
+		if !alt.Before(end) && sameWall(alt, w) {
+			return t, alt
+		}
+	}
+
+	return t, time.Time{}
+}
+
+// Returns the wall clock time of 't' (in UTC, i.e. no DST).
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+func sameWall(t, w time.Time) bool {
+	return t.Year() == w.Year() && t.YearDay() == w.YearDay() && t.Hour() == w.Hour() &&
+		t.Minute() == w.Minute() && t.Second() == w.Second()
+}
+
+// Returns true if the wall clock of 't' is before the wall clock time 'w'.
+func wallBefore(t, w time.Time) bool {
+	return wallClock(t).Before(w)
+}
+
+// Returns up to 'count' fire times of the schedule after 't'.
+func nextTimes(s schedule, t time.Time, count int) []time.Time {
+	var times []time.Time
+	for i := 0; i < count; i++ {
+		t = s.next(t)
+		if t.IsZero() {
+			break
+		}
+
+		times = append(times, t)
+	}
+
+	return times
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want string // normalized
+	}{
+		{"* * * * *", "0 * * * * *"},
+		{"30 * * * * *", "30 * * * * *"},
+		{"15,45 * * * *", "0 15,45 * * * *"},
+		{"0 9-17 * * 1-5", "0 0 9-17 * * 1-5"},
+		{"10-50/10 * * * *", "0 10-50/10 * * * *"},
+		{"*/15 * * * *", "0 */15 * * * *"},
+		{"5/20 * * * *", "0 5-45/20 * * * *"},
+		{"0 0 */2 * *", "0 0 0 */2 * *"},
+		{"0 8 * JAN,JUL MON", "0 0 8 * 1,7 1"},
+		{"0 8 * jan-mar mon-fri", "0 0 8 * 1-3 1-5"},
+		{"0 0 * * 7", "0 0 0 * * 0"},
+		{"0 0 * * 5-7", "0 0 0 * * 0,5,6"},
+		{"0 0 * * 0,7", "0 0 0 * * 0"},
+		{"0 0 1 * MON", "0 0 0 1 * 1"},
+		{"0 0 1,15 * *", "0 0 0 1,15 * *"},
+	} {
+		s, err := parseCron(tc.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.spec, err)
+			continue
+		}
+
+		if got := s.String(); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{"* * * *", `expected 5 or 6 fields, found 4: "* * * *"`},
+		{"* * * * * * *", `expected 5 or 6 fields, found 7: "* * * * * * *"`},
+		{"60 * * * *", "minute: value 60 out of range (0-59)"},
+		{"* 24 * * *", "hour: value 24 out of range (0-23)"},
+		{"* * 0 * *", "day of month: value 0 out of range (1-31)"},
+		{"* * * 13 *", "month: value 13 out of range (1-12)"},
+		{"* * * * 8", "day of week: value 8 out of range (0-7)"},
+		{"60 * * * * *", "second: value 60 out of range (0-59)"},
+		{"* * * FOO *", `month: invalid value "FOO"`},
+		{"* * * * MONDAY", `day of week: invalid value "MONDAY"`},
+		{"5-1 * * * *", `minute: invalid range "5-1"`},
+		{"*/0 * * * *", `minute: invalid step in "*/0"`},
+		{"*/x * * * *", `minute: invalid step in "*/x"`},
+		{"1,,2 * * * *", "minute: empty item"},
+	} {
+		_, err := parseCron(tc.spec)
+		if err == nil {
+			t.Errorf("%q: expected an error", tc.spec)
+			continue
+		}
+
+		if err.Error() != tc.want {
+			t.Errorf("%q: got error %q, want %q", tc.spec, err, tc.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{"@foo", `unknown macro "@foo"`},
+		{"@daily 5", `unknown macro "@daily 5"`},
+		{"@every", "@every expects a duration, i.e. @every 90s"},
+		{"@every 500ms", `@every: invalid duration "500ms" (1s minimum)`},
+		{"@reboot 5", "@reboot takes no arguments"},
+		{"FOO=UTC 0 0 * * *", `unknown prefix "FOO=UTC"`},
+		{"CRON_TZ=Nowhere/Nothing 0 0 * * *", `unknown time zone "Nowhere/Nothing"`},
+	} {
+		_, err := parseSchedule(tc.spec)
+		if err == nil {
+			t.Errorf("%q: expected an error", tc.spec)
+			continue
+		}
+
+		if err.Error() != tc.want {
+			t.Errorf("%q: got error %q, want %q", tc.spec, err, tc.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+
+		return t
+	}
+
+	for _, tc := range []struct {
+		spec string
+		from string
+		want []string // empty if the schedule never fires
+	}{
+		// Names, lists and ranges.
+		{"0 8 * JAN,JUL MON", "2024-01-01T00:00:00Z", []string{"2024-01-01T08:00:00Z", "2024-01-08T08:00:00Z"}},
+		{"0 8 * JAN,JUL MON", "2024-01-29T09:00:00Z", []string{"2024-07-01T08:00:00Z", "2024-07-08T08:00:00Z"}},
+		{"0 9-17 * * 1-5", "2024-01-05T17:30:00Z", []string{"2024-01-08T09:00:00Z", "2024-01-08T10:00:00Z"}},
+		{"10-50/20 * * * *", "2024-01-01T10:00:00Z", []string{"2024-01-01T10:10:00Z", "2024-01-01T10:30:00Z", "2024-01-01T10:50:00Z", "2024-01-01T11:10:00Z"}},
+
+		// 'n/step' is 'n-max/step'.
+		{"5/20 * * * *", "2024-01-01T10:00:00Z", []string{"2024-01-01T10:05:00Z", "2024-01-01T10:25:00Z", "2024-01-01T10:45:00Z", "2024-01-01T11:05:00Z"}},
+
+		// 7 is Sunday.
+		{"0 0 * * 7", "2024-01-01T00:00:00Z", []string{"2024-01-07T00:00:00Z", "2024-01-14T00:00:00Z"}},
+
+		// Day of month and day of week both restricted: either one.
+		{"0 0 1 * MON", "2024-01-01T00:00:00Z", []string{"2024-01-08T00:00:00Z", "2024-01-15T00:00:00Z", "2024-01-22T00:00:00Z", "2024-01-29T00:00:00Z", "2024-02-01T00:00:00Z", "2024-02-05T00:00:00Z"}},
+
+		// Only one of them restricted: that one.
+		{"0 0 1 * *", "2024-01-01T00:00:00Z", []string{"2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z"}},
+		{"0 0 * * MON", "2024-01-01T00:00:00Z", []string{"2024-01-08T00:00:00Z", "2024-01-15T00:00:00Z"}},
+
+		// Feb 29 only in leap years.
+		{"0 0 29 2 *", "2024-03-01T00:00:00Z", []string{"2028-02-29T00:00:00Z"}},
+
+		// Seconds field.
+		{"*/20 * * * * *", "2024-01-01T10:00:00Z", []string{"2024-01-01T10:00:20Z", "2024-01-01T10:00:40Z", "2024-01-01T10:01:00Z"}},
+
+		// Impossible dates never fire.
+		{"0 0 30 2 *", "2024-01-01T00:00:00Z", nil},
+		{"0 0 31 4,6,9,11 *", "2024-01-01T00:00:00Z", nil},
+	} {
+		s, err := parseSchedule("CRON_TZ=UTC " + tc.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.spec, err)
+			continue
+		}
+
+		got := nextTimes(s, utc(tc.from), len(tc.want)+1)
+		if len(tc.want) == 0 {
+			if len(got) != 0 {
+				t.Errorf("%q: expected no fire times, got %v", tc.spec, got)
+			}
+
+			continue
+		}
+
+		for i, want := range tc.want {
+			if i >= len(got) || !got[i].Equal(utc(want)) {
+				t.Errorf("%q from %s: got %v, want %v", tc.spec, tc.from, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04 MST", s, ny)
+		if err != nil {
+			panic(err)
+		}
+
+		return t
+	}
+
+	for _, tc := range []struct {
+		spec string
+		from string
+		want []string
+	}{
+		// Spring forward (Mar 10, 2024 02:00 EST -> 03:00 EDT): 2:30 doesn't exist that day, it fires
+		// once at the end of the gap.
+		{"30 2 * * *", "2024-03-09 12:00 EST", []string{"2024-03-10 03:00 EDT", "2024-03-11 02:30 EDT"}},
+		{"0,30 2 * * *", "2024-03-09 12:00 EST", []string{"2024-03-10 03:00 EDT", "2024-03-11 02:00 EDT"}},
+		{"0 3 * * *", "2024-03-09 12:00 EST", []string{"2024-03-10 03:00 EDT", "2024-03-11 03:00 EDT"}},
+
+		// Fall back (Nov 3, 2024 02:00 EDT -> 01:00 EST): the 1:xx hour happens twice, it fires once,
+		// on the first one.
+		{"30 1 * * *", "2024-11-02 12:00 EDT", []string{"2024-11-03 01:30 EDT", "2024-11-04 01:30 EST"}},
+		{"0,30 1 * * *", "2024-11-02 12:00 EDT", []string{"2024-11-03 01:00 EDT", "2024-11-03 01:30 EDT", "2024-11-04 01:00 EST"}},
+		{"30 1 * * *", "2024-11-03 01:45 EDT", []string{"2024-11-04 01:30 EST"}},
+		{"30 1 * * *", "2024-11-03 01:10 EST", []string{"2024-11-04 01:30 EST"}},
+		{"0 2 * * *", "2024-11-02 12:00 EDT", []string{"2024-11-03 02:00 EST", "2024-11-04 02:00 EST"}},
+
+		// Unless a '*' in the minute or hour field: then both 1:xx hours (same as Vixie cron).
+		{"*/15 * * * *", "2024-11-03 01:40 EDT", []string{"2024-11-03 01:45 EDT", "2024-11-03 01:00 EST", "2024-11-03 01:15 EST", "2024-11-03 01:30 EST", "2024-11-03 01:45 EST", "2024-11-03 02:00 EST"}},
+		{"30 * * * *", "2024-11-03 00:45 EDT", []string{"2024-11-03 01:30 EDT", "2024-11-03 01:30 EST", "2024-11-03 02:30 EST"}},
+		{"*/20 1 * * *", "2024-11-03 01:50 EDT", []string{"2024-11-03 01:00 EST", "2024-11-03 01:20 EST", "2024-11-03 01:40 EST", "2024-11-04 01:00 EST"}},
+		{"0 */30 * * * *", "2024-11-03 01:40 EDT", []string{"2024-11-03 01:00 EST", "2024-11-03 01:30 EST", "2024-11-03 02:00 EST"}},
+		{"*/15 * * * *", "2024-11-03 01:10 EST", []string{"2024-11-03 01:15 EST", "2024-11-03 01:30 EST"}},
+		{"*/15 * * * *", "2024-03-10 01:40 EST", []string{"2024-03-10 01:45 EST", "2024-03-10 03:00 EDT", "2024-03-10 03:15 EDT"}},
+	} {
+		s, err := parseSchedule("CRON_TZ=America/New_York " + tc.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.spec, err)
+			continue
+		}
+
+		got := nextTimes(s, at(tc.from), len(tc.want))
+		for i, want := range tc.want {
+			if i >= len(got) || !got[i].Equal(at(want)) {
+				t.Errorf("%q from %s: got %v, want %v", tc.spec, tc.from, got, tc.want)
+				break
+			}
+		}
+	}
+}
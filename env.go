@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// Expand %VAR% and ${VAR} in 's' using 'env' ("KEY=VALUE" items, names are case-insensitive like on
+// Windows). Unknown variables are left as is, like cmd.exe does; '%%' is a literal '%'.
+func expandVars(s string, env []string) string {
+	lookup := func(name string) (string, bool) {
+		for i := len(env) - 1; i >= 0; i-- {
+			kv := strings.SplitN(env[i], "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], name) {
+				return kv[1], true
+			}
+		}
+
+		return "", false
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "%%"):
+			b.WriteByte('%')
+			i++
+			continue
+		case s[i] == '%':
+			if end := strings.IndexByte(s[i+1:], '%'); end > 0 {
+				if val, ok := lookup(s[i+1 : i+1+end]); ok {
+					b.WriteString(val)
+					i += end + 1
+					continue
+				}
+			}
+		case strings.HasPrefix(s[i:], "${"):
+			if end := strings.IndexByte(s[i+2:], '}'); end > 0 {
+				if val, ok := lookup(s[i+2 : i+2+end]); ok {
+					b.WriteString(val)
+					i += end + 2
+					continue
+				}
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// Returns the service's environment with the "KEY=VALUE" items in 'vars' added or replacing the
+// existing ones. Values can refer to other variables, i.e. PATH=%PATH%;c:\tools.
+func mergeEnv(vars []string) []string {
+	env := os.Environ()
+	for _, v := range vars {
+		kv := strings.SplitN(v, "=", 2)
+		val := expandVars(kv[1], env)
+		var rest []string
+		for _, e := range env {
+			if !strings.EqualFold(strings.SplitN(e, "=", 2)[0], kv[0]) {
+				rest = append(rest, e)
+			}
+		}
+
+		env = append(rest, kv[0]+"="+val)
+	}
+
+	return env
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Run history retention.
+const (
+	HISTORY_MAX_RUNS   = 10000               // most recent runs kept
+	HISTORY_MAX_AGE    = 30 * 24 * time.Hour // runs older than this are dropped
+	HISTORY_MAX_OUTPUT = 4096                // bytes of stdout and stderr kept per run (the end of it)
+	HISTORY_TAIL_RUNS  = 1000                // most recent runs also kept in memory, for queries
+)
+
+// A finished run as saved in the history file and returned by the runs endpoint.
+type runRecord struct {
+	Job      string    `json:"job"`
+	Source   string    `json:"source"` // i.e. run.conf:12, or exec for /exec runs
+	Attempt  int       `json:"attempt"`
+	Args     []string  `json:"args"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Status   string    `json:"status"`
+	ExitCode int       `json:"exitcode"`
+	Error    string    `json:"error,omitempty"`
+	Stdout   string    `json:"stdout,omitempty"`
+	Stderr   string    `json:"stderr,omitempty"`
+	Log      string    `json:"log,omitempty"` // output log file
+}
+
+func newRunRecord(run *jobRun) *runRecord {
+	rec := runRecord{
+		Job:      run.job,
+		Source:   run.source,
+		Attempt:  run.attempt,
+		Args:     run.args,
+		Start:    run.start,
+		End:      run.end,
+		Status:   run.status,
+		ExitCode: run.exitCode,
+		Stdout:   truncateOutput(run.stdout, run.stdoutLen),
+		Stderr:   truncateOutput(run.stderr, run.stderrLen),
+		Log:      run.log,
+	}
+
+	if run.err != nil {
+		rec.Error = run.err.Error()
+	}
+
+	return &rec
+}
+
+// Keep the end of the output, that's where the errors usually are. 'total' is the size of the whole
+// output if 'b' is already only the end of it.
+func truncateOutput(b []byte, total int) string {
+	if len(b) > HISTORY_MAX_OUTPUT {
+		b = b[len(b)-HISTORY_MAX_OUTPUT:]
+	}
+
+	if total <= len(b) {
+		return string(b)
+	}
+
+	return fmt.Sprintf("[%d bytes truncated]...", total-len(b)) + string(b)
+}
+
+// Keeps the last 'max' bytes written, the output of a run is in its log file.
+type tailBuffer struct {
+	buf   []byte
+	max   int
+	total int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.total += len(p)
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.max:]...)
+	}
+
+	return len(p), nil
+}
+
+// Run history, saved as JSON lines (one run per line) in the service's folder. New runs are
+// appended; the file is rewritten without the old runs once in a while. The most recent runs are
+// also kept in memory so most queries don't read the file.
+type runHistory struct {
+	mtx       sync.Mutex
+	path      string
+	loaded    bool         // the file was read once, count and tail are set
+	count     int          // runs in the file
+	tail      []*runRecord // last HISTORY_TAIL_RUNS runs in the file, oldest first
+	compacted time.Time    // last time the old runs were removed
+}
+
+func historyFile() string {
+	path, _ := getModuleFileName()
+	return filepath.Dir(path) + `\runs.jsonl`
+}
+
+func newRunHistory(path string) *runHistory {
+	return &runHistory{path: path}
+}
+
+// Append a finished run.
+func (h *runHistory) add(run *jobRun) error {
+	rec := newRunRecord(run)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if err := h.load(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	h.count++
+	h.setTail(append(h.tail, rec))
+	if h.count > HISTORY_MAX_RUNS+HISTORY_MAX_RUNS/10 || time.Since(h.compacted) > 24*time.Hour {
+		return h.compact()
+	}
+
+	return nil
+}
+
+// Rewrite the file with the runs within the retention limits only. Call with h.mtx held.
+func (h *runHistory) compact() error {
+	recs, err := h.read()
+	if err != nil {
+		return err
+	}
+
+	if len(recs) > HISTORY_MAX_RUNS {
+		recs = recs[len(recs)-HISTORY_MAX_RUNS:]
+	}
+
+	tmp := h.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range recs {
+		if err = enc.Encode(rec); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, h.path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	h.count, h.compacted = len(recs), time.Now()
+	h.setTail(recs)
+	return nil
+}
+
+// Read the file the first time it's needed. Call with h.mtx held.
+func (h *runHistory) load() error {
+	if h.loaded {
+		return nil
+	}
+
+	recs, err := h.read()
+	if err != nil {
+		return err
+	}
+
+	h.loaded, h.count = true, len(recs)
+	h.setTail(recs)
+	return nil
+}
+
+// Keep the last HISTORY_TAIL_RUNS of 'recs' in memory. Call with h.mtx held.
+func (h *runHistory) setTail(recs []*runRecord) {
+	if len(recs) > HISTORY_TAIL_RUNS {
+		recs = recs[len(recs)-HISTORY_TAIL_RUNS:]
+	}
+
+	h.tail = append([]*runRecord(nil), recs...)
+}
+
+// Returns the runs within the retention age, oldest first. Lines that can't be parsed are skipped.
+// Call with h.mtx held.
+func (h *runHistory) read() ([]*runRecord, error) {
+	f, err := os.Open(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+	var recs []*runRecord
+	min := time.Now().Add(-HISTORY_MAX_AGE)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec runRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || rec.Start.Before(min) {
+			continue
+		}
+
+		recs = append(recs, &rec)
+	}
+
+	return recs, scanner.Err()
+}
+
+// Returns the last 'limit' runs of 'job' (all jobs if empty) started at or after 'since', oldest
+// first. The file is only read if the runs in memory are not enough.
+func (h *runHistory) query(job string, since time.Time, limit int) ([]*runRecord, error) {
+	h.mtx.Lock()
+	if err := h.load(); err != nil {
+		h.mtx.Unlock()
+		return nil, err
+	}
+
+	recs := h.tail
+	res := lastRuns(recs, job, since, limit)
+	if len(res) < limit && h.count > len(recs) {
+		var err error
+		if recs, err = h.read(); err != nil {
+			h.mtx.Unlock()
+			return nil, err
+		}
+
+		res = lastRuns(recs, job, since, limit)
+	}
+
+	h.mtx.Unlock()
+
+	// The log files compressed since the runs were recorded are now .log.gz. The records of the tail
+	// are shared, so they are copied.
+	for i, rec := range res {
+		if path := logPath(rec.Log); path != rec.Log {
+			cp := *rec
+			cp.Log = path
+			res[i] = &cp
+		}
+	}
+
+	return res, nil
+}
+
+// Returns the last 'limit' runs in 'recs' (oldest first) of 'job' (all jobs if empty) started at or
+// after 'since' and within the retention age, oldest first.
+func lastRuns(recs []*runRecord, job string, since time.Time, limit int) []*runRecord {
+	if min := time.Now().Add(-HISTORY_MAX_AGE); since.Before(min) {
+		since = min
+	}
+
+	var res []*runRecord
+	for i := len(recs) - 1; i >= 0 && len(res) < limit; i-- {
+		if rec := recs[i]; (job == "" || rec.Job == job) && !rec.Start.Before(since) {
+			res = append(res, rec)
+		}
+	}
+
+	out := make([]*runRecord, len(res))
+	for i, rec := range res {
+		out[len(res)-1-i] = rec
+	}
+
+	return out
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A job as returned by the jobs endpoint.
+type jobInfo struct {
+	ID       string       `json:"id"`     // name, or the run.conf line if it has no name
+	Source   string       `json:"source"` // i.e. run.conf:12
+	Name     string       `json:"name,omitempty"`
+	Schedule string       `json:"schedule"` // normalized, i.e. '@daily' is '0 0 0 * * *'
+	Args     []string     `json:"args"`
+	Enabled  bool         `json:"enabled"`
+	Running  int          `json:"running"` // active runs
+	Pending  int          `json:"pending"` // runs waiting for a worker
+	LastRun  *lastRunInfo `json:"lastrun,omitempty"`
+	NextRun  string       `json:"nextrun,omitempty"` // RFC3339, with the jitter delay; none for @reboot and @manual
+
+	// Only when inspecting a single job.
+	Options map[string]interface{} `json:"options,omitempty"` // effective options, as in run.conf
+	Next    []string               `json:"next,omitempty"`
+	Runs    []*runRecord           `json:"runs,omitempty"` // most recent runs, oldest first
+}
+
+type lastRunInfo struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Attempt  int       `json:"attempt"`
+	Status   string    `json:"status"`
+	ExitCode int       `json:"exitcode"`
+}
+
+// Returns true if the job was disabled through the http interface.
+func (c *svcContext) isDisabled(j *job) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.disabled[j.id()]
+}
+
+// Enable or disable job 'id' (see config.jobByID). Disabled jobs don't run on their schedule, at
+// start (@reboot) or when chained. The setting is kept in state.json so it survives restarts.
+// Returns the job's id.
+func (c *svcContext) setEnabled(id string, enabled bool) (string, error) {
+	j := c.config().jobByID(id)
+	if j != nil {
+		id = j.id()
+	}
+
+	c.mtx.Lock()
+	if j == nil && !(enabled && c.disabled[id]) {
+		// Jobs removed from run.conf can still be enabled, so they don't stay disabled if added back.
+		c.mtx.Unlock()
+		return "", fmt.Errorf("job not found: %s", id)
+	}
+
+	if enabled {
+		delete(c.disabled, id)
+	} else {
+		c.disabled[id] = true
+	}
+
+	c.mtx.Unlock()
+	c.traceInfo(id, ": enabled: ", enabled)
+	return id, c.saveState()
+}
+
+// Queue a run of the job now, outside of its schedule. Disabled jobs can also be run this way. The
+// job's overlap policy applies like for a scheduled run.
+func (c *svcContext) runNow(j *job) error {
+	c.mtx.Lock()
+	st := c.jobState(j.id())
+	running, pending := st.running, st.pending
+	c.mtx.Unlock()
+	switch {
+	case j.overlap == OVERLAP_SKIP && running+pending > 0:
+		return fmt.Errorf("previous run still active (overlap=skip)")
+	case j.overlap == OVERLAP_QUEUE && pending > 0:
+		return fmt.Errorf("a run is already queued (overlap=queue)")
+	}
+
+	c.traceInfo(j.where(), ": run requested")
+	c.dispatch(j, []time.Time{time.Now()})
+	return nil
+}
+
+// Returns the job's details. With 'detail', also its options, its next 'count' fire times and its
+// last 'count' runs from the run history.
+func (c *svcContext) jobInfo(j *job, detail bool, count int) *jobInfo {
+	now := time.Now()
+	info := jobInfo{
+		ID:       j.id(),
+		Source:   j.where(),
+		Name:     j.name,
+		Schedule: j.sched.String(),
+		Args:     j.args,
+	}
+
+	c.mtx.Lock()
+	info.Enabled = !c.disabled[j.id()]
+	if st, ok := c.jobs[j.id()]; ok {
+		info.Running, info.Pending = st.running, st.pending
+		if st.last != nil {
+			info.LastRun = &lastRunInfo{
+				Start:    st.last.Start,
+				End:      st.last.End,
+				Attempt:  st.last.Attempt,
+				Status:   st.last.Status,
+				ExitCode: st.last.ExitCode,
+			}
+		}
+	}
+
+	c.mtx.Unlock()
+	if t := j.sched.next(now); !t.IsZero() {
+		info.NextRun = t.Add(j.startDelay()).Format(time.RFC3339)
+	}
+
+	if !detail {
+		return &info
+	}
+
+	info.Options = j.options()
+	info.Next = []string{}
+	for _, t := range nextTimes(j.sched, now, count) {
+		info.Next = append(info.Next, t.Add(j.startDelay()).Format(time.RFC3339))
+	}
+
+	runs, err := c.history.query(j.id(), time.Time{}, count)
+	if err != nil {
+		c.traceError("Cannot read run history: ", err)
+	}
+
+	info.Runs = runs
+	return &info
+}
+
+// Returns the job's effective options, with the run.conf names.
+func (j *job) options() map[string]interface{} {
+	opts := map[string]interface{}{
+		"misfire":      j.misfire,
+		"misfirelimit": j.misfireLimit,
+		"overlap":      j.overlap,
+		"retries":      j.retries,
+		"retrydelay":   j.retryDelay.String(),
+		"backoff":      j.backoff,
+		"quoting":      QUOTING_WINDOWS,
+	}
+
+	if j.concurrency > 0 {
+		opts["concurrency"] = j.concurrency
+	}
+
+	if j.timeout > 0 {
+		opts["timeout"] = j.timeout.String()
+	}
+
+	if len(j.retryCodes) > 0 {
+		var codes []int
+		for code := range j.retryCodes {
+			codes = append(codes, code)
+		}
+
+		sort.Ints(codes)
+		var s []string
+		for _, code := range codes {
+			s = append(s, strconv.Itoa(code))
+		}
+
+		opts["retrycodes"] = strings.Join(s, ",")
+	}
+
+	if j.jitter > 0 {
+		opts["jitter"] = j.jitter.String()
+	}
+
+	if j.quoting != "" {
+		opts["quoting"] = j.quoting
+	}
+
+	if j.cwd != "" {
+		opts["cwd"] = j.cwd
+	}
+
+	if len(j.env) > 0 {
+		opts["env"] = j.env
+	}
+
+	if len(j.onSuccess) > 0 {
+		opts["onsuccess"] = strings.Join(j.onSuccess, ",")
+	}
+
+	if len(j.onFailure) > 0 {
+		opts["onfailure"] = strings.Join(j.onFailure, ",")
+	}
+
+	if len(j.tags) > 0 {
+		opts["tags"] = strings.Join(j.tags, ",")
+	}
+
+	if j.loc != nil {
+		opts["CRON_TZ"] = j.loc.String()
+	}
+
+	return opts
+}
+
+// Set the last run of every job from the run history, so it's known right after a restart.
+func (c *svcContext) loadLastRuns() {
+	recs, err := c.history.query("", time.Time{}, HISTORY_MAX_RUNS)
+	if err != nil {
+		c.traceError("Cannot read run history: ", err)
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, rec := range recs {
+		if rec.Source != "exec" {
+			c.jobState(rec.Job).last = rec
+		}
+	}
+}
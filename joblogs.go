@@ -0,0 +1,362 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job output logs, one file per run in logs\<job>\<start time>.log under the service's folder. A
+// run's output goes to more files (<start time>.1.log, ...) if it grows beyond the maximum size.
+type jobLogs struct {
+	mtx      sync.Mutex
+	dir      string
+	open     map[string]bool // files of active runs; not compressed or deleted
+	cleaned  time.Time       // last cleanup
+	cleaning bool            // a cleanup is running
+}
+
+func logsDir() string {
+	path, _ := getModuleFileName()
+	return filepath.Dir(path) + `\logs`
+}
+
+func newJobLogs(dir string) *jobLogs {
+	return &jobLogs{dir: dir, open: map[string]bool{}}
+}
+
+// Returns the folder name of a job's logs. Names are used as is; other job ids (the run.conf line)
+// are reduced to safe characters with a hash to keep them unique.
+func jobLogDir(id string) string {
+	safe := []byte(id)
+	changed := false
+	for i, c := range safe {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			safe[i] = '_'
+			changed = true
+		}
+	}
+
+	if !changed && len(safe) <= 64 && id != "." && id != ".." {
+		return id
+	}
+
+	if len(safe) > 48 {
+		safe = safe[:48]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return fmt.Sprintf("%s-%08x", safe, h.Sum32())
+}
+
+// Writes the output of one run, starting a new file when the current one reaches 'maxSize'.
+type logWriter struct {
+	mtx     sync.Mutex
+	logs    *jobLogs
+	base    string // path without the .log extension
+	maxSize int64
+	part    int
+	f       *os.File
+	size    int64
+	err     error // first error; the output is not written after it
+}
+
+// Create the log of a run of job 'id' that starts at 'start'.
+func (l *jobLogs) create(id string, start time.Time, maxSize int64) (*logWriter, error) {
+	dir := l.dir + `\` + jobLogDir(id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &logWriter{logs: l, base: dir + `\` + start.Format("20060102T150405.000"), maxSize: maxSize}
+	if err := w.openPart(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *logWriter) path() string {
+	if w.part == 0 {
+		return w.base + ".log"
+	}
+
+	return fmt.Sprintf("%s.%d.log", w.base, w.part)
+}
+
+func (w *logWriter) openPart() error {
+	f, err := os.OpenFile(w.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.logs.mtx.Lock()
+	w.logs.open[w.path()] = true
+	w.logs.mtx.Unlock()
+	w.f, w.size = f, 0
+	return nil
+}
+
+func (w *logWriter) closePart() {
+	w.f.Close()
+	w.logs.mtx.Lock()
+	delete(w.logs.open, w.path())
+	w.logs.mtx.Unlock()
+}
+
+// Safe to use for both stdout and stderr.
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.err != nil {
+		return len(p), nil // don't fail the run because of its log
+	}
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		w.closePart()
+		w.part++
+		if w.err = w.openPart(); w.err != nil {
+			return len(p), nil
+		}
+	}
+
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		w.err = err
+	}
+
+	return len(p), nil
+}
+
+// Returns the path of the first file.
+func (w *logWriter) Close() string {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.err == nil {
+		w.closePart()
+	}
+
+	return w.base + ".log"
+}
+
+// Returns the current path of the log file 'path' of a finished run: path.gz once compressed
+// (loggzip). Unchanged if neither exists, i.e. deleted.
+func logPath(path string) string {
+	if !strings.HasSuffix(path, ".log") {
+		return path
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(path + ".gz"); err == nil {
+			return path + ".gz"
+		}
+	}
+
+	return path
+}
+
+// Apply the retention settings: delete the logs older than the maximum age, compress the logs of
+// finished runs and delete the oldest logs while the total size is above the quota. Runs at most
+// once a minute. The files are listed under l.mtx but compressed and deleted without it, so running
+// jobs can rotate and close their logs meanwhile; the files of finished runs are never written again.
+func (l *jobLogs) cleanup(s logSettings) error {
+	l.mtx.Lock()
+	if l.cleaning || time.Since(l.cleaned) < time.Minute {
+		l.mtx.Unlock()
+		return nil
+	}
+
+	l.cleaned, l.cleaning = time.Now(), true
+	files, err := l.list("")
+	var (
+		done  []logFile // of finished runs
+		total int64
+	)
+
+	for _, fi := range files {
+		if l.open[fi.path] {
+			total += fi.size
+		} else {
+			done = append(done, fi)
+		}
+	}
+
+	l.mtx.Unlock()
+	defer func() {
+		l.mtx.Lock()
+		l.cleaning = false
+		l.mtx.Unlock()
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(done); i++ {
+		fi := done[i]
+		switch {
+		case s.maxAge > 0 && time.Since(fi.modTime) > s.maxAge:
+			os.Remove(fi.path)
+			done = append(done[:i], done[i+1:]...)
+			i--
+			continue
+		case s.gzip && strings.HasSuffix(fi.path, ".log"):
+			if size, err := gzipFile(fi.path); err == nil {
+				fi.path, fi.size = fi.path+".gz", size
+				done[i] = fi
+			}
+		}
+
+		total += fi.size
+	}
+
+	// Oldest first.
+	sort.Slice(done, func(i, k int) bool { return done[i].modTime.Before(done[k].modTime) })
+	for _, fi := range done {
+		if s.quota <= 0 || total <= s.quota {
+			break
+		}
+
+		if os.Remove(fi.path) == nil {
+			total -= fi.size
+		}
+	}
+
+	return nil
+}
+
+type logFile struct {
+	path    string
+	name    string
+	job     string // folder name
+	size    int64
+	modTime time.Time
+}
+
+// Returns the log files of the job folder 'job' (all jobs if empty). Call with l.mtx held.
+func (l *jobLogs) list(job string) ([]logFile, error) {
+	dirs := []string{job}
+	if job == "" {
+		fis, err := ioutil.ReadDir(l.dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		dirs = nil
+		for _, fi := range fis {
+			if fi.IsDir() {
+				dirs = append(dirs, fi.Name())
+			}
+		}
+	}
+
+	var files []logFile
+	for _, dir := range dirs {
+		fis, err := ioutil.ReadDir(l.dir + `\` + dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		for _, fi := range fis {
+			if !fi.IsDir() && isLogName(fi.Name()) {
+				files = append(files, logFile{
+					path:    l.dir + `\` + dir + `\` + fi.Name(),
+					name:    fi.Name(),
+					job:     dir,
+					size:    fi.Size(),
+					modTime: fi.ModTime(),
+				})
+			}
+		}
+	}
+
+	return files, nil
+}
+
+func isLogName(name string) bool {
+	return name == filepath.Base(name) && (strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.gz"))
+}
+
+// Compress 'path' to 'path'.gz and delete it. Returns the compressed size.
+func gzipFile(path string) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer in.Close()
+	out, err := os.Create(path + ".gz.tmp")
+	if err != nil {
+		return 0, err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+
+	out.Close()
+	in.Close()
+	if err == nil {
+		err = os.Rename(path+".gz.tmp", path+".gz")
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz.tmp")
+		return 0, err
+	}
+
+	os.Remove(path)
+	fi, err := os.Stat(path + ".gz")
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// Open a log file for reading, decompressed if needed.
+func (l *jobLogs) openFile(job, name string) (io.ReadCloser, error) {
+	if !isLogName(name) || jobLogDir(job) != job {
+		return nil, fmt.Errorf("invalid log file")
+	}
+
+	f, err := os.Open(l.dir + `\` + job + `\` + name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(name, ".gz") {
+		return f, nil
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
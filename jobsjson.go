@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jobs.json, a structured alternative to run.conf:
+//
+//	{
+//	  "workers": 8,
+//	  "defaults": {"misfire": "once", "tz": "UTC"},
+//	  "jobs": [
+//	    {"name": "backup", "schedule": "0 2 * * *", "command": "cmd.exe /c backup.bat", "timeout": "20m"},
+//	    {"schedule": "@every 90s", "command": ["probe.exe", "--url", "http://localhost"]}
+//	  ]
+//	}
+type jobsFileDef struct {
+	Workers    *int          `json:"workers"`
+	LogMaxSize string        `json:"logmaxsize"`
+	LogMaxAge  string        `json:"logmaxage"`
+	LogGzip    *bool         `json:"loggzip"`
+	LogQuota   string        `json:"logquota"`
+	Defaults   jobDef        `json:"defaults"`
+	Jobs       []jobDef      `json:"jobs"`
+	Blackouts  []blackoutDef `json:"blackouts"`
+}
+
+// A job in jobs.json. The fields map one-to-one to the run.conf job options.
+type jobDef struct {
+	Name         string            `json:"name,omitempty"`
+	Schedule     string            `json:"schedule,omitempty"`
+	Command      json.RawMessage   `json:"command,omitempty"` // a command line string or an array of arguments
+	Quoting      string            `json:"quoting,omitempty"` // for a command line string
+	Cwd          string            `json:"cwd,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	Misfire      string            `json:"misfire,omitempty"`
+	MisfireLimit *int              `json:"misfirelimit,omitempty"`
+	Overlap      string            `json:"overlap,omitempty"`
+	Concurrency  *int              `json:"concurrency,omitempty"`
+	Timeout      string            `json:"timeout,omitempty"`
+	Retries      *int              `json:"retries,omitempty"`
+	RetryDelay   string            `json:"retrydelay,omitempty"`
+	Backoff      string            `json:"backoff,omitempty"`
+	RetryCodes   []int             `json:"retrycodes,omitempty"`
+	Jitter       string            `json:"jitter,omitempty"`
+	OnSuccess    []string          `json:"onsuccess,omitempty"`
+	OnFailure    []string          `json:"onfailure,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	TZ           string            `json:"tz,omitempty"`
+}
+
+// Returns the options that are set, as run.conf 'key=value' pairs.
+func (d *jobDef) options() [][2]string {
+	var opts [][2]string
+	add := func(key, val string) {
+		if val != "" {
+			opts = append(opts, [2]string{key, val})
+		}
+	}
+
+	itoa := func(n *int) string {
+		if n == nil {
+			return ""
+		}
+
+		return strconv.Itoa(*n)
+	}
+
+	var codes []string
+	for _, c := range d.RetryCodes {
+		codes = append(codes, strconv.Itoa(c))
+	}
+
+	add("name", d.Name)
+	add("misfire", d.Misfire)
+	add("misfirelimit", itoa(d.MisfireLimit))
+	add("overlap", d.Overlap)
+	add("concurrency", itoa(d.Concurrency))
+	add("timeout", d.Timeout)
+	add("retries", itoa(d.Retries))
+	add("retrydelay", d.RetryDelay)
+	add("backoff", d.Backoff)
+	add("retrycodes", strings.Join(codes, ","))
+	add("jitter", d.Jitter)
+	add("onsuccess", strings.Join(d.OnSuccess, ","))
+	add("onfailure", strings.Join(d.OnFailure, ","))
+	add("tags", strings.Join(d.Tags, ","))
+	add("TZ", d.TZ)
+	add("quoting", d.Quoting)
+	add("cwd", d.Cwd)
+	var keys []string
+	for k := range d.Env {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		opts = append(opts, [2]string{"env", k + "=" + d.Env[k]})
+	}
+
+	return opts
+}
+
+// Returns the command line; either split from a string like in run.conf or the array as is.
+func (d *jobDef) args(quoting string) ([]string, error) {
+	var s string
+	if err := json.Unmarshal(d.Command, &s); err == nil {
+		return splitCmdLine(s, quoting)
+	}
+
+	var args []string
+	if err := json.Unmarshal(d.Command, &args); err != nil {
+		return nil, fmt.Errorf("command: expected a string or an array of strings")
+	}
+
+	return args, nil
+}
+
+// Apply the job definition on top of the defaults in 'def'.
+func (d *jobDef) toJob(def job) (*job, error) {
+	j := def
+	for _, kv := range d.options() {
+		if err := j.setOption(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.Schedule == "" {
+		return nil, fmt.Errorf("missing schedule")
+	}
+
+	if err := j.setSchedule(d.Schedule); err != nil {
+		return nil, err
+	}
+
+	args, err := d.args(j.quoting)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing command")
+	}
+
+	j.args = args
+	j.text = d.Schedule + " " + strings.Join(args, " ")
+	return &j, nil
+}
+
+// Parse jobs.json style content from file 'src' and add the jobs to the config. Job errors are
+// reported as <src>:<n>, 'n' being the position of the job in the list.
+func (cf *config) parseJSON(src string, b []byte) []error {
+	var f jobsFileDef
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return []error{fmt.Errorf("%s: %v", src, err)}
+	}
+
+	globals := [][2]string{{"logmaxsize", f.LogMaxSize}, {"logmaxage", f.LogMaxAge}, {"logquota", f.LogQuota}}
+	if f.Workers != nil {
+		globals = append(globals, [2]string{"workers", strconv.Itoa(*f.Workers)})
+	}
+
+	if f.LogGzip != nil {
+		globals = append(globals, [2]string{"loggzip", strconv.FormatBool(*f.LogGzip)})
+	}
+
+	for _, kv := range globals {
+		if kv[1] == "" {
+			continue
+		}
+
+		if _, err := cf.setGlobal(kv[0], kv[1]); err != nil {
+			return []error{fmt.Errorf("%s: %v", src, err)}
+		}
+	}
+
+	if f.Defaults.Name != "" || f.Defaults.Schedule != "" || len(f.Defaults.Command) > 0 {
+		return []error{fmt.Errorf("%s: defaults: only job options can be defaults", src)}
+	}
+
+	def := defaultJob()
+	for _, kv := range f.Defaults.options() {
+		if err := def.setOption(kv[0], kv[1]); err != nil {
+			return []error{fmt.Errorf("%s: defaults: %v", src, err)}
+		}
+	}
+
+	var errs []error
+	for n, d := range f.Jobs {
+		j, err := d.toJob(def)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", src, n+1, err))
+			continue
+		}
+
+		j.src = src
+		j.line = n + 1
+		cf.jobs = append(cf.jobs, j)
+	}
+
+	for n, d := range f.Blackouts {
+		if d.ID != 0 {
+			errs = append(errs, fmt.Errorf("%s: blackouts[%d]: id is not allowed", src, n+1))
+			continue
+		}
+
+		b, err := d.toBlackout(def.loc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: blackouts[%d]: %v", src, n+1, err))
+			continue
+		}
+
+		b.src = fmt.Sprintf("%s:blackouts[%d]", src, n+1)
+		cf.blackouts = append(cf.blackouts, b)
+	}
+
+	return errs
+}
@@ -1,24 +1,28 @@
+//go:build windows
+// +build windows
+
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"time"
 
 	"github.com/urfave/cli"
 	"golang.org/x/sys/windows/svc"
 )
 
 const (
-	svcName         = "holly"
-	internalVersion = "1.10"
-	usage           = "Simple command scheduler (Windows service)"
-	copyright       = "(c) 2016 Chew Esmero."
+	usage     = "Simple command scheduler (Windows service)"
+	copyright = "(c) 2016 Chew Esmero."
 )
 
 func main() {
 	isIntSess, err := svc.IsAnInteractiveSession()
 	if err != nil {
-		log.Println("Failed to determine if we are running in an interactive session: %v", err)
+		log.Printf("Failed to determine if we are running in an interactive session: %v", err)
 		return
 	}
 
@@ -75,6 +79,69 @@ func main() {
 				return controlService(svcName, svc.Continue, svc.Running)
 			},
 		},
+		{
+			Name:      "next",
+			Usage:     "print the next fire times of a schedule expression",
+			ArgsUsage: `"<expr>"`,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "count, n",
+					Value: 5,
+					Usage: "number of fire times to print",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				sched, err := parseSchedule(c.Args().First())
+				if err != nil {
+					return err
+				}
+
+				for _, t := range nextTimes(sched, time.Now(), c.Int("count")) {
+					fmt.Println(t.Format(time.RFC3339))
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:      "validate",
+			Usage:     "check a config file (or the installed config) without applying it",
+			ArgsUsage: "[file]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "fragment, f",
+					Usage: "the file goes to run.conf.d",
+				},
+				cli.IntFlag{
+					Name:  "count, n",
+					Value: 3,
+					Usage: "number of fire times to print per job",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				var (
+					name string
+					b    []byte
+					err  error
+				)
+
+				if file := c.Args().First(); file != "" {
+					if b, err = ioutil.ReadFile(file); err != nil {
+						return err
+					}
+
+					name = validateName(file, c.Bool("fragment"))
+				}
+
+				res := validateConf(name, b, c.Int("count"))
+				res.print(os.Stdout)
+				if !res.Valid {
+					return cli.NewExitError("", 1)
+				}
+
+				return nil
+			},
+		},
 	}
 
 	app.Run(os.Args)
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Only the scheduler's tests run on other systems; the service needs Windows.
+func main() {
+	fmt.Fprintln(os.Stderr, svcName, "runs as a Windows service only")
+	os.Exit(1)
+}
@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestWaitProcessTimeout(t *testing.T) {
+	// The background sleep holds stdout open; if only the shell was killed, Wait would block until
+	// WaitDelay.
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30")
+	cmd.Stdout = &out
+	if err := startProcess(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	timedOut, err := waitProcess(cmd, 200*time.Millisecond)
+	if !timedOut || err == nil {
+		t.Errorf("got timedOut %v, err %v, want a timeout", timedOut, err)
+	}
+
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("took %v, the process tree was not terminated", d)
+	}
+
+	if code := exitCode(cmd); code != -1 {
+		t.Errorf("got exit code %d, want -1", code)
+	}
+}
+
+func TestWaitProcess(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		code int
+		fail bool
+	}{
+		{[]string{"sh", "-c", "exit 0"}, 0, false},
+		{[]string{"sh", "-c", "exit 3"}, 3, true},
+	} {
+		cmd := newCommand(tc.args)
+		if err := startProcess(cmd); err != nil {
+			t.Fatal(err)
+		}
+
+		timedOut, err := waitProcess(cmd, 10*time.Second)
+		if timedOut || (err != nil) != tc.fail || exitCode(cmd) != tc.code {
+			t.Errorf("%q: got timedOut %v, err %v, exit code %d", tc.args, timedOut, err, exitCode(cmd))
+		}
+	}
+}
+
+func TestWaitProcessLeftoverChild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for WaitDelay")
+	}
+
+	// Exits with 0 but leaves a child holding stdout: a success once WaitDelay is over.
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", "sleep 30 & exit 0")
+	cmd.Stdout = &out
+	if err := startProcess(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	defer killProcessTree(cmd)
+	timedOut, err := waitProcess(cmd, 0)
+	if timedOut || err != nil || exitCode(cmd) != 0 {
+		t.Errorf("got timedOut %v, err %v, exit code %d, want a success", timedOut, err, exitCode(cmd))
+	}
+}
@@ -0,0 +1,29 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// Nothing to do here; taskkill.exe walks the process tree by itself.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Terminate the process and all its child processes.
+func killProcessTree(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	tk := exec.Command("c:/windows/system32/taskkill.exe", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	tk.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	if err := tk.Run(); err != nil {
+		// Make sure at least the process itself goes away.
+		return cmd.Process.Kill()
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Start the command in its own process group (see setProcessGroup) so that its whole process tree
+// can be terminated later.
+func startProcess(cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	// Don't wait forever for pipes held open by orphaned children once the process has exited.
+	cmd.WaitDelay = 5 * time.Second
+	return cmd.Start()
+}
+
+// Wait for a started command to finish. If it takes longer than 'timeout' (0 is no limit), its whole
+// process tree is terminated and the returned bool is true.
+func waitProcess(cmd *exec.Cmd, timeout time.Duration) (bool, error) {
+	done := make(chan error, 1)
+	go func() { done <- waitCommand(cmd) }()
+	if timeout <= 0 {
+		return false, <-done
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return false, err
+	case <-t.C:
+		killProcessTree(cmd)
+		<-done
+		return true, fmt.Errorf("timed out after %v", timeout)
+	}
+}
+
+// Same as cmd.Wait but a command that exited with 0 is a success even if a child it left running
+// (i.e. 'cmd /c start ...') still holds its output open after WaitDelay; that output is lost.
+func waitCommand(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) && exitCode(cmd) == 0 {
+		return nil
+	}
+
+	return err
+}
+
+// Returns the exit code of a finished command, or -1 if it didn't run to completion.
+func exitCode(cmd *exec.Cmd) int {
+	if cmd.ProcessState == nil {
+		return -1
+	}
+
+	return cmd.ProcessState.ExitCode()
+}
+
+func newCommand(args []string) *exec.Cmd {
+	if len(args) == 0 {
+		return nil
+	}
+
+	return exec.Command(args[0], args[1:]...)
+}
+
+// Run the command line (an ad-hoc run, i.e. from /exec) and return its record, with the console
+// output. The whole process tree is terminated if it runs longer than 'timeout' (0 is no limit).
+func execute(args []string, timeout time.Duration) *jobRun {
+	run := jobRun{job: "exec", source: "exec", args: args, attempt: 1, start: time.Now(), status: RUN_OK}
+	cmd := newCommand(args)
+	if cmd == nil {
+		run.end, run.status, run.exitCode, run.err = time.Now(), RUN_FAILED, -1, fmt.Errorf("empty command")
+		return &run
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := startProcess(cmd); err != nil {
+		run.end, run.status, run.exitCode, run.err = time.Now(), RUN_FAILED, -1, err
+		return &run
+	}
+
+	timedOut, err := waitProcess(cmd, timeout)
+	run.end, run.exitCode, run.err = time.Now(), exitCode(cmd), err
+	run.stdout, run.stderr = stdout.Bytes(), stderr.Bytes()
+	switch {
+	case timedOut:
+		run.status = RUN_TIMEOUT
+	case err != nil:
+		run.status = RUN_FAILED
+	}
+
+	return &run
+}
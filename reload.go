@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often the config files (run.conf, jobs.json and run.conf.d) are checked for changes.
+const CONF_POLL = 5 * time.Second
+
+// Status of the job table, served by the conf/status endpoint.
+type confStatus struct {
+	Files    []string  `json:"files"`    // config files found, in load order
+	Modified time.Time `json:"modified"` // latest modification time of the files last read
+	Loaded   time.Time `json:"loaded"`   // when the active job table was applied
+	Jobs     int       `json:"jobs"`     // in the active job table
+	Errors   []string  `json:"errors"`   // of the files last read; if any, they were not applied
+	LastGood bool      `json:"lastgood"` // the active job table is from lastconf.json
+}
+
+// The last applied config, used at start when the current files have errors.
+type lastConf struct {
+	Saved time.Time  `json:"saved"`
+	Files []confText `json:"files"`
+}
+
+func lastConfFile() string {
+	return filepath.Dir(confFile()) + `\lastconf.json`
+}
+
+// Write to a temporary file first, same as state.json.
+func saveLastConf(cf *config) error {
+	b, err := json.Marshal(lastConf{Saved: time.Now(), Files: cf.files})
+	if err != nil {
+		return err
+	}
+
+	tmp := lastConfFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, lastConfFile())
+}
+
+// Returns the last applied config, nil if there is none (i.e. first start after an upgrade).
+func loadLastConf() (*config, time.Time, error) {
+	b, err := ioutil.ReadFile(lastConfFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+
+		return nil, time.Time{}, err
+	}
+
+	var lc lastConf
+	if err := json.Unmarshal(b, &lc); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	cf, errs := parseConfFiles(lc.Files)
+	if len(errs) > 0 {
+		return nil, time.Time{}, fmt.Errorf("%s: %v", filepath.Base(lastConfFile()), errs[0])
+	}
+
+	return cf, lc.Saved, nil
+}
+
+// Returns the active job table.
+func (c *svcContext) config() *config {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.conf
+}
+
+// Parse the config files again if any of them changed (or appeared or was removed) since the last
+// call. A config with errors is not applied; the previous job table stays active and the errors
+// are reported. At start, the previous job table is the last applied config saved in lastconf.json.
+// Returns true if a new job table was applied.
+func (c *svcContext) reloadConf() bool {
+	c.reloadMtx.Lock()
+	defer c.reloadMtx.Unlock()
+	var (
+		files []string
+		sig   string
+		mod   time.Time
+	)
+
+	srcs, _ := confSources()
+	for _, src := range srcs {
+		fi, err := os.Stat(src.path)
+		if err != nil {
+			continue
+		}
+
+		files = append(files, src.name)
+		sig += fmt.Sprint(src.path, fi.ModTime().UnixNano(), fi.Size(), ";")
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+
+	if c.conf != nil && sig == c.confSig {
+		return false
+	}
+
+	c.confSig = sig
+	cf, errs := readConf()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.confStat.Files, c.confStat.Modified, c.confStat.Errors = files, mod, nil
+	if len(errs) > 0 {
+		for _, err := range errs {
+			c.traceError(err)
+			c.confStat.Errors = append(c.confStat.Errors, err.Error())
+		}
+
+		if c.conf == nil {
+			c.conf = c.lastGoodConf()
+			c.workers = c.conf.workers
+		}
+
+		c.traceError("Config not applied, ", len(errs), " error(s). Keeping the previous jobs (", len(c.conf.jobs), ").")
+		return false
+	}
+
+	c.conf = cf
+	c.workers = cf.workers
+	c.confStat.Loaded, c.confStat.Jobs, c.confStat.LastGood = time.Now(), len(cf.jobs), false
+	c.traceInfo("Config loaded, jobs: ", len(cf.jobs), ", workers: ", cf.workers)
+	if err := saveLastConf(cf); err != nil {
+		c.traceError("Cannot save ", lastConfFile(), ": ", err)
+	}
+
+	return true
+}
+
+// Returns the last applied config (an empty one if there is none) for a start with config errors.
+// Call with c.mtx held.
+func (c *svcContext) lastGoodConf() *config {
+	cf, saved, err := loadLastConf()
+	if err != nil {
+		c.traceError("Cannot load the last applied config: ", err)
+	}
+
+	if cf == nil {
+		return newConfig()
+	}
+
+	c.confStat.Loaded, c.confStat.Jobs, c.confStat.LastGood = saved, len(cf.jobs), true
+	c.traceInfo("Using the last applied config (", saved.Format(time.RFC3339), "), jobs: ", len(cf.jobs))
+	return cf
+}
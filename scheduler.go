@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// Runtime state of a job, kept across evaluations.
+type jobState struct {
+	running int                     // number of running processes
+	pending int                     // number of runs waiting in the queue
+	cmds    map[*exec.Cmd]*procInfo // running processes, for overlap=kill
+	killc   chan struct{}           // closed on overlap=kill, to cancel runs waiting for a retry
+	last    *runRecord              // last finished run, from the run history at start
+}
+
+// A process of a running job. It's registered before it starts, so an overlap=kill can't miss it.
+type procInfo struct {
+	started bool // false while it's still starting
+	killed  bool // by overlap=kill
+}
+
+// A job run waiting for a free worker.
+type runRequest struct {
+	job *job
+	at  time.Time // fire time
+	seq uint64    // submit order, for ties
+}
+
+// Runs are started in (fire time, run.conf order, submit order) order, so it's deterministic when
+// the pool is full.
+func (r *runRequest) before(o *runRequest) bool {
+	if !r.at.Equal(o.at) {
+		return r.at.Before(o.at)
+	}
+
+	if r.job.order != o.job.order {
+		return r.job.order < o.job.order
+	}
+
+	return r.seq < o.seq
+}
+
+func (c *svcContext) jobState(id string) *jobState {
+	st, ok := c.jobs[id]
+	if !ok {
+		st = &jobState{cmds: map[*exec.Cmd]*procInfo{}, killc: make(chan struct{})}
+		c.jobs[id] = st
+	}
+
+	return st
+}
+
+// Queue the runs of a job for the fire times in 'times'. If the job still has active runs, its
+// overlap policy decides what to do. Queued runs start as soon as there is a free worker and the
+// job is below its own limit of active runs.
+func (c *svcContext) dispatch(j *job, times []time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	st := c.jobState(j.id())
+	if st.running+st.pending > 0 {
+		switch j.overlap {
+		case OVERLAP_SKIP:
+			c.traceInfo(j.id(), ": previous run still active (overlap=skip). Skip.")
+			return
+		case OVERLAP_QUEUE:
+			if st.pending > 0 {
+				c.traceInfo(j.id(), ": a run is already queued (overlap=queue). Skip.")
+				return
+			}
+
+			c.traceInfo(j.id(), ": previous run still active (overlap=queue). Queued.")
+		case OVERLAP_KILL:
+			for cmd, p := range st.cmds {
+				p.killed = true
+				if !p.started {
+					// Killed by runAttempt once started.
+					c.traceInfo(j.id(), ": killing previous run (overlap=kill) once started")
+					continue
+				}
+
+				c.traceInfo(j.id(), ": killing previous run (overlap=kill), pid: ", cmd.Process.Pid)
+				// Terminating a process tree can take a while (taskkill.exe), so it doesn't hold up
+				// the caller (i.e. the main loop) nor c.mtx.
+				go killProcessTree(cmd)
+			}
+
+			close(st.killc)
+			st.killc = make(chan struct{})
+		}
+	}
+
+	for _, t := range times {
+		c.seq++
+		r := &runRequest{job: j, at: t, seq: c.seq}
+		i := len(c.queue)
+		for i > 0 && r.before(c.queue[i-1]) {
+			i--
+		}
+
+		c.queue = append(c.queue, nil)
+		copy(c.queue[i+1:], c.queue[i:])
+		c.queue[i] = r
+		st.pending++
+	}
+
+	c.startQueued()
+}
+
+// Like dispatch but after the job's start delay (jitter), if any, and not in a blackout window. Used
+// for scheduled runs; chained runs start right away.
+func (c *svcContext) dispatchDelayed(j *job, times []time.Time) {
+	d := j.startDelay()
+	if d == 0 {
+		if !c.blackedOut(j) {
+			c.dispatch(j, times)
+		}
+
+		return
+	}
+
+	c.trace(j.id(), ": start delayed by ", d, " (jitter=", j.jitter, ")")
+	time.AfterFunc(d, func() {
+		if !c.blackedOut(j) {
+			c.dispatch(j, times)
+		}
+	})
+}
+
+// Start queued runs while there are free workers. Runs of a job that is at its own limit stay in
+// the queue, but don't block the runs of other jobs behind them. Call with c.mtx held.
+func (c *svcContext) startQueued() {
+	workers := c.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var rest []*runRequest
+	for _, r := range c.queue {
+		st := c.jobState(r.job.id())
+		max := r.job.maxActive()
+		if c.running >= workers || (max > 0 && st.running >= max) {
+			rest = append(rest, r)
+			continue
+		}
+
+		st.pending--
+		st.running++
+		c.running++
+		go c.runJob(r.job, st)
+	}
+
+	c.queue = rest
+}
+
+// Run statuses.
+const (
+	RUN_OK      = "ok"
+	RUN_FAILED  = "failed"  // non-zero exit code or cannot start
+	RUN_TIMEOUT = "timeout" // killed after 'timeout'
+	RUN_KILLED  = "killed"  // killed by a newer run (overlap=kill)
+	RUN_SKIPPED = "skipped" // not started, in a blackout window
+)
+
+// Record of a finished job run.
+type jobRun struct {
+	job       string
+	attempt   int // 1 for the first, then +1 for every retry
+	start     time.Time
+	end       time.Time
+	status    string
+	exitCode  int
+	err       error
+	source    string // where the job is defined (i.e. run.conf:12), exec for /exec runs
+	args      []string
+	stdout    []byte // possibly only the end of the output
+	stderr    []byte
+	stdoutLen int // size of the whole output
+	stderrLen int
+	log       string // output log file, if any
+}
+
+// Run the job, with retries if it fails. Every attempt is recorded separately. Waiting for a retry
+// holds on to the worker.
+func (c *svcContext) runJob(j *job, st *jobState) {
+	defer func() {
+		c.mtx.Lock()
+		st.running--
+		c.running--
+		c.startQueued()
+		c.mtx.Unlock()
+	}()
+
+	for attempt := 1; ; attempt++ {
+		run := c.runAttempt(j, st, attempt)
+		if run == nil {
+			return
+		}
+
+		if !j.shouldRetry(run) {
+			c.runChained(j, run)
+			return
+		}
+
+		delay := j.retryDelayAfter(attempt)
+		c.traceInfo(j.id(), ": attempt ", attempt, " of ", j.retries+1, " failed, retry in ", delay)
+		c.mtx.Lock()
+		killc := st.killc
+		c.mtx.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-killc:
+			c.traceInfo(j.id(), ": retry cancelled (overlap=kill).")
+			return
+		}
+	}
+}
+
+// Queue the follow-up jobs of 'j' (onsuccess/onfailure) for its final run. Runs killed by a newer
+// run (overlap=kill) have no follow-ups. The jobs are looked up in the current run.conf, so chains
+// pick up reloads.
+func (c *svcContext) runChained(j *job, run *jobRun) {
+	var names []string
+	switch run.status {
+	case RUN_OK:
+		names = j.onSuccess
+	case RUN_FAILED, RUN_TIMEOUT:
+		names = j.onFailure
+	}
+
+	for _, name := range names {
+		c.mtx.Lock()
+		next := c.conf.job(name)
+		c.mtx.Unlock()
+		if next == nil {
+			c.traceError(j.id(), ": chained job not found: ", name)
+			continue
+		}
+
+		if c.isDisabled(next) {
+			c.traceInfo(j.id(), ": chained job disabled: ", name, ". Skip.")
+			continue
+		}
+
+		if c.blackedOut(next) {
+			continue
+		}
+
+		c.traceInfo(j.id(), ": ", run.status, ", run chained job: ", name)
+		c.dispatch(next, []time.Time{time.Now()})
+	}
+}
+
+func (c *svcContext) runAttempt(j *job, st *jobState, attempt int) *jobRun {
+	args, dir, env := j.command()
+	cmd := newCommand(args)
+	if cmd == nil {
+		return nil
+	}
+
+	stdout := &tailBuffer{max: HISTORY_MAX_OUTPUT}
+	stderr := &tailBuffer{max: HISTORY_MAX_OUTPUT}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.Dir, cmd.Env = dir, env
+	run := jobRun{job: j.id(), source: j.where(), args: args, attempt: attempt, start: time.Now(), status: RUN_OK}
+	c.traceInfo("Execute: ", args)
+
+	// The whole output (both streams) goes to the job's log file.
+	var lw *logWriter
+	settings := c.config().logs
+	if c.logs != nil {
+		var err error
+		if lw, err = c.logs.create(j.id(), run.start, settings.maxSize); err != nil {
+			c.traceError(j.id(), ": cannot create output log: ", err)
+		} else {
+			fmt.Fprintf(lw, "# %s %q attempt %d at %s\r\n", j.where(), args, attempt, run.start.Format(time.RFC3339))
+			cmd.Stdout, cmd.Stderr = io.MultiWriter(stdout, lw), io.MultiWriter(stderr, lw)
+		}
+	}
+
+	finish := func() *jobRun {
+		if lw != nil {
+			fmt.Fprintf(lw, "\r\n# %s, exit code: %d, err: %v\r\n", run.status, run.exitCode, run.err)
+			run.log = lw.Close()
+			go c.logs.cleanup(settings)
+		}
+
+		c.mtx.Lock()
+		st.last = newRunRecord(&run)
+		c.mtx.Unlock()
+
+		c.record(&run)
+		return &run
+	}
+
+	// Registered before it starts but c.mtx isn't held while starting; an overlap=kill in between is
+	// done here.
+	p := &procInfo{}
+	c.mtx.Lock()
+	st.cmds[cmd] = p
+	c.mtx.Unlock()
+	err := startProcess(cmd)
+	c.mtx.Lock()
+	p.started = err == nil
+	killed := p.killed
+	if err != nil {
+		delete(st.cmds, cmd)
+	}
+
+	c.mtx.Unlock()
+	if err != nil {
+		run.end, run.status, run.exitCode, run.err = time.Now(), RUN_FAILED, -1, err
+		return finish()
+	}
+
+	if killed {
+		c.traceInfo(j.id(), ": killing run (overlap=kill), pid: ", cmd.Process.Pid)
+		killProcessTree(cmd)
+	}
+
+	timedOut, err := waitProcess(cmd, j.timeout)
+	c.mtx.Lock()
+	killed = p.killed
+	delete(st.cmds, cmd)
+	c.mtx.Unlock()
+
+	run.end, run.exitCode, run.err = time.Now(), exitCode(cmd), err
+	run.stdout, run.stderr = stdout.buf, stderr.buf
+	run.stdoutLen, run.stderrLen = stdout.total, stderr.total
+	switch {
+	case timedOut:
+		run.status = RUN_TIMEOUT
+	case killed:
+		run.status = RUN_KILLED
+	case err != nil:
+		run.status = RUN_FAILED
+	}
+
+	return finish()
+}
+
+// Log the run and add it to the run history.
+func (c *svcContext) record(run *jobRun) {
+	if c.history != nil {
+		if err := c.history.add(run); err != nil {
+			c.traceError("Cannot save run history: ", err)
+		}
+	}
+
+	m := fmt.Sprint(run.job, ": ", run.status, ", attempt: ", run.attempt, ", exit code: ", run.exitCode,
+		", duration: ", run.end.Sub(run.start))
+	switch run.status {
+	case RUN_OK:
+		c.traceInfo(m)
+		return
+	case RUN_SKIPPED:
+		c.traceInfo(m, ", ", run.err)
+		return
+	}
+
+	c.traceError(m, ", err: ", run.err)
+}
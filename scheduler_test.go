@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRunRequestBefore(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	a, b := &job{order: 1}, &job{order: 2}
+
+	// Expected order: fire time, then run.conf order, then submit order.
+	want := []*runRequest{
+		{job: b, at: t0.Add(-time.Minute), seq: 9},
+		{job: a, at: t0, seq: 5},
+		{job: a, at: t0, seq: 7},
+		{job: b, at: t0, seq: 1},
+		{job: b, at: t0, seq: 2},
+		{job: a, at: t0.Add(time.Second), seq: 3},
+	}
+
+	for i, r := range want {
+		if r.before(r) {
+			t.Errorf("%d: before itself", i)
+		}
+
+		for _, o := range want[i+1:] {
+			if !r.before(o) || o.before(r) {
+				t.Errorf("%d: (%v, %d, %d) should be before (%v, %d, %d)", i, r.at, r.job.order, r.seq, o.at, o.job.order, o.seq)
+			}
+		}
+	}
+
+	got := []*runRequest{want[3], want[5], want[1], want[0], want[4], want[2]}
+	sort.Slice(got, func(i, k int) bool { return got[i].before(got[k]) })
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%d: got (%v, %d, %d), want (%v, %d, %d)", i, got[i].at, got[i].job.order, got[i].seq, want[i].at, want[i].job.order, want[i].seq)
+		}
+	}
+}
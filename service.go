@@ -1,142 +1,111 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"runtime"
+	"sort"
 	"strconv"
 	"strings"
-	"sync/atomic"
-	"syscall"
+	"sync"
 	"time"
-	"unsafe"
-
-	"github.com/gorilla/mux"
-	"github.com/tylerb/graceful"
-	"github.com/urfave/negroni"
-	"golang.org/x/sys/windows/svc"
-	"golang.org/x/sys/windows/svc/debug"
-	"golang.org/x/sys/windows/svc/eventlog"
 )
 
-var el debug.Log
+const (
+	svcName         = "holly"
+	internalVersion = "1.10"
+)
 
 type httpContextValue struct {
 	ipaddr string
 }
 
-type etw struct {
-	mod  *syscall.LazyDLL
-	proc *syscall.LazyProc
-	init bool
-}
-
-func (e *etw) trace(v ...interface{}) {
-	if !e.init {
-		return
-	}
-
-	pc, _, _, _ := runtime.Caller(1)
-	fn := runtime.FuncForPC(pc)
-	fno := regexp.MustCompile(`^.*\.(.*)$`)
-	fnName := fno.ReplaceAllString(fn.Name(), "$1")
-	m := fmt.Sprint(v...) // does not insert space in between items.
-	_, _, _ = e.proc.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr("[" + fnName + "] " + m))))
-}
-
-// Trace + eventlog info entry.
-func (e *etw) traceInfo(v ...interface{}) {
-	if !e.init {
-		return
-	}
-
-	pc, _, _, _ := runtime.Caller(1)
-	fn := runtime.FuncForPC(pc)
-	fno := regexp.MustCompile(`^.*\.(.*)$`)
-	fnName := fno.ReplaceAllString(fn.Name(), "$1")
-	m := fmt.Sprint(v...) // does not insert space in between items.
-	_, _, _ = e.proc.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr("[" + fnName + "] " + m))))
-	el.Info(1, m)
-}
-
-// Trace + eventlog error entry.
-func (e *etw) traceError(v ...interface{}) {
-	if !e.init {
-		return
-	}
-
-	pc, _, _, _ := runtime.Caller(1)
-	fn := runtime.FuncForPC(pc)
-	fno := regexp.MustCompile(`^.*\.(.*)$`)
-	fnName := fno.ReplaceAllString(fn.Name(), "$1")
-	m := fmt.Sprint(v...) // does not insert space in between items.
-	_, _, _ = e.proc.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr("[" + fnName + "] " + m))))
-	el.Error(1, m)
+// Service's main context structure.
+type svcContext struct {
+	*etw                             // embedded etw tracer
+	mtx         sync.Mutex           // protects the fields below
+	last        time.Time            // last evaluated fire time; only the main loop changes it
+	jobs        map[string]*jobState // runtime state per job id
+	disabled    map[string]bool      // ids of the jobs disabled through the http interface
+	tasks       map[int]*atTask      // pending one-off tasks by id
+	taskSeq     int                  // last task id
+	blackouts   map[int]*blackout    // blackout windows added through the http interface, by id
+	blackoutSeq int                  // last blackout window id
+	queue       []*runRequest        // runs waiting for a free worker
+	seq         uint64               // run request counter
+	running     int                  // number of running jobs
+	workers     int                  // size of the worker pool
+	conf        *config              // active job table from run.conf and jobs.json
+
+	reloadMtx sync.Mutex // serializes config reloads
+	confSig   string     // config files' names, modification times and sizes at the last reload
+	confStat  confStatus // protected by mtx
+
+	history  *runHistory // finished runs
+	logs     *jobLogs    // job output logs
+	stateMtx sync.Mutex  // serializes state.json saves
+	wakec    chan struct{}
 }
 
-func newEtw() *etw {
-	path, _ := getModuleFileName()
-	lib := filepath.Dir(path) + `\disptrace.dll`
-	if _, err := os.Stat(lib); os.IsNotExist(err) {
-		return nil
-	}
-
-	mod := syscall.NewLazyDLL(lib)
-	proc := mod.NewProc("ETWTrace")
-	return &etw{mod: mod, proc: proc, init: true}
+func handleHttpGetInternalVersion(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":"` + internalVersion + `"}`))
+	})
 }
 
-// Service's main context structure.
-type svcContext struct {
-	*etw                  // embedded etw tracer
-	busy  int32           // 0 = idle; 1 = busy
-	mruns map[string]bool // run state for cmd lines
-}
+// Preview the next fire times of a schedule expression. Query params: 'expr' (required) and 'count'
+// (default 5, max 100).
+func handleHttpGetScheduleNext(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		expr := q.Get("expr")
+		count := 5
+		if val, ok := q["count"]; ok {
+			n, err := strconv.Atoi(val[0])
+			if err != nil || n < 1 || n > 100 {
+				http.Error(w, "count should be between 1 and 100", 500)
+				return
+			}
 
-func (c *svcContext) setUpdateSelfAfterReboot(old string, new string) error {
-	var (
-		sysproc                     = syscall.MustLoadDLL("kernel32.dll").MustFindProc("MoveFileExW")
-		MOVEFILE_DELAY_UNTIL_REBOOT = 0x4
-	)
+			count = n
+		}
 
-	o, err := syscall.UTF16PtrFromString(old)
-	if err != nil {
-		c.trace(err)
-	}
+		sched, err := parseSchedule(expr)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 
-	n, err := syscall.UTF16PtrFromString(new)
-	if err != nil {
-		c.trace(err)
-	}
+		next := []string{}
+		for _, t := range nextTimes(sched, time.Now(), count) {
+			next = append(next, t.Format(time.RFC3339))
+		}
 
-	// Register file replacements.
-	_, _, _ = sysproc.Call(uintptr(unsafe.Pointer(o)), 0, uintptr(MOVEFILE_DELAY_UNTIL_REBOOT))
-	_, _, _ = sysproc.Call(uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(o)), uintptr(MOVEFILE_DELAY_UNTIL_REBOOT))
-	_, _, _ = sysproc.Call(uintptr(unsafe.Pointer(n)), 0, uintptr(MOVEFILE_DELAY_UNTIL_REBOOT))
-	return nil
-}
+		payload, err := json.Marshal(map[string]interface{}{"expr": expr, "next": next})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 
-func handleHttpGetInternalVersion(c *svcContext) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`{"version":"` + internalVersion + `"}`))
+		w.Write(payload)
 	})
 }
 
 func handleHttpGetExec(c *svcContext) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
-			interactive bool = false
-			wait        bool = true
-			waitms      int  = 5000
+			interactive bool          = false
+			wait        bool          = true
+			waitms      int           = 5000
+			timeout     time.Duration = 0
+			quoting     string        = QUOTING_WINDOWS
 		)
 
 		q := r.URL.Query()
@@ -168,37 +137,109 @@ func handleHttpGetExec(c *svcContext) http.HandlerFunc {
 			}
 		}
 
+		// Kill the command (and its child processes) if it runs longer than this. Not for 'interactive'.
+		if val, ok := q["timeout"]; ok {
+			d, err := time.ParseDuration(val[0])
+			if err != nil || d < 0 {
+				http.Error(w, "invalid timeout (i.e. 30s, 10m, 1h)", 500)
+				return
+			}
+
+			timeout = d
+		}
+
+		if val, ok := q["quoting"]; ok {
+			if val[0] != QUOTING_WINDOWS && val[0] != QUOTING_POSIX {
+				http.Error(w, "invalid quoting (windows or posix)", 500)
+				return
+			}
+
+			quoting = val[0]
+		}
+
 		v := httpContextValue{ipaddr: r.RemoteAddr}
 		ctx := context.WithValue(context.Background(), "data", v)
-		doExec(ctx, c, w, cmd, interactive, wait, waitms)
+		doExec(ctx, c, w, cmd, quoting, interactive, wait, waitms, timeout)
 	})
 }
 
 // This is quite dangerous since we can execute virtually any command, considering that this service
 // is running as SYSTEM account in session 0.
-func doExec(ctx context.Context, c *svcContext, w http.ResponseWriter, cmd string, interactive, wait bool, waitms int) {
+func doExec(ctx context.Context, c *svcContext, w http.ResponseWriter, cmd string, quoting string, interactive, wait bool, waitms int, timeout time.Duration) {
 	ip := ctx.Value("data").(httpContextValue).ipaddr + ` | `
 	c.trace(ip, cmd)
-	args := strings.Split(cmd, " ")
 	if interactive {
-		c.traceInfo(ip, "cmd: ", args[0])
-		c.traceInfo(ip, "args (joined): ", strings.Join(args[1:], " "))
-		r, err := runInteractive(args[0], strings.Join(args[1:], " "), wait, waitms)
+		// The arguments are passed as is, only the program is split off.
+		prog, rest, _, err := nextArg(cmd, quoting)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		rest = strings.TrimSpace(rest)
+		c.traceInfo(ip, "cmd: ", prog)
+		c.traceInfo(ip, "args (joined): ", rest)
+		r, err := runInteractive(prog, rest, wait, waitms)
 		c.traceInfo(ip, "return: ", r, ", err: ", err)
-		w.Write([]byte(`{"cmd":"` + cmd + `","return":"` + fmt.Sprintf("%s", r) + `","error":"` + err.Error() + `"}`))
+		res := map[string]interface{}{"cmd": cmd, "return": r}
+		if err != nil {
+			res["error"] = err.Error()
+		}
+
+		b, _ := json.Marshal(res)
+		w.Write(b)
+		return
+	}
+
+	args, err := splitCmdLine(cmd, quoting)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	res, err := execute(args)
+	run := execute(args, timeout)
+	c.record(run)
+	c.traceInfo(ip, "doExec: cmd = ", cmd, " | exit code = ", run.exitCode, " | result = ", string(run.stdout))
+	res := execResult{
+		Cmd:      cmd,
+		Args:     args,
+		Status:   run.status,
+		ExitCode: run.exitCode,
+		Result:   string(run.stdout),
+		Stderr:   string(run.stderr),
+		Duration: run.end.Sub(run.start).String(),
+	}
+
+	if run.err != nil {
+		c.traceError(ip, run.err)
+		res.Error = run.err.Error()
+	}
+
+	b, err := json.Marshal(res)
 	if err != nil {
-		c.traceError(ip, err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	sres := fmt.Sprintf("%s", res)
-	c.traceInfo(ip, "doExec: cmd = ", cmd, " | result = ", sres)
-	w.Write([]byte(`{"cmd":"` + cmd + `","result":"` + sres + `"}`))
+	// Failed runs are still a 500, but with the output and exit code.
+	w.Header().Set("Content-Type", "application/json")
+	if run.status != RUN_OK {
+		w.WriteHeader(500)
+	}
+
+	w.Write(b)
+}
+
+// Response of /exec (not interactive).
+type execResult struct {
+	Cmd      string   `json:"cmd"`
+	Args     []string `json:"args"`
+	Status   string   `json:"status"`   // ok, failed or timeout
+	ExitCode int      `json:"exitcode"` // -1 if the command cannot start
+	Result   string   `json:"result"`   // stdout
+	Stderr   string   `json:"stderr"`
+	Error    string   `json:"error,omitempty"`
+	Duration string   `json:"duration"`
 }
 
 func handleHttpGetFileStat(c *svcContext) http.HandlerFunc {
@@ -432,427 +473,577 @@ func handleHttpPostUpdateConf(c *svcContext) http.HandlerFunc {
 		}
 
 		defer file.Close()
-		atomic.StoreInt32(&c.busy, 1)
-		defer atomic.StoreInt32(&c.busy, 0)
 		str := fmt.Sprintf("Handler.Header: %v", handler.Header)
 		c.trace(ip, str)
 		path, _ := getModuleFileName()
 		_, fstr := filepath.Split(handler.Filename)
 		fstr = filepath.Dir(path) + `\` + fstr
-		f, err := os.Create(fstr)
+		conf := "" // config file name as in confSource, empty if the file is not one
+		if strings.EqualFold(filepath.Base(fstr), "run.conf") || strings.EqualFold(filepath.Base(fstr), "jobs.json") {
+			conf = validateName(fstr, false)
+		}
+
+		// With 'fragment', only replace (or add) that file in run.conf.d.
+		if name := r.URL.Query().Get("fragment"); name != "" {
+			if !isFragmentName(name) {
+				http.Error(w, "invalid fragment name (<name>.conf or <name>.json)", 500)
+				return
+			}
+
+			if err := os.MkdirAll(confDir(), 0755); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+			fstr = confDir() + `\` + name
+			conf = validateName(name, true)
+		}
+
+		body, err := ioutil.ReadAll(file)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
 
-		defer f.Close()
-		io.Copy(f, file)
+		// A config with errors would not be applied (and none at all after a restart), so it's
+		// rejected and the current file is left as is.
+		if conf != "" {
+			if _, errs := readConfWith(conf, body); len(errs) > 0 {
+				http.Error(w, confErrors(errs), 500)
+				return
+			}
+		}
+
+		// Write to a temporary file first then replace, so the scheduler never reads a partial file.
+		err = ioutil.WriteFile(fstr+".tmp", body, 0644)
+		if err == nil {
+			err = os.Rename(fstr+".tmp", fstr)
+		}
+
+		if err != nil {
+			os.Remove(fstr + ".tmp")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		c.reloadConf()
 		w.Write([]byte(`{"result":"Config file updated."}`))
 	})
 }
 
-// Upload any file to some location.
-func handleHttpPostUpload(c *svcContext) http.HandlerFunc {
+// Returns the config errors as the body of a rejected upload, one per line.
+func confErrors(errs []error) string {
+	str := fmt.Sprintf("Config not updated, %d error(s):", len(errs))
+	for _, err := range errs {
+		str += "\n" + err.Error()
+	}
+
+	return str
+}
+
+// Check a config file (request body) without applying it. The 'file' query parameter is the file
+// name (run.conf by default, or jobs.json); with 'fragment' instead, it's a file in run.conf.d. An
+// empty body checks the current files.
+func handleHttpPostConfValidate(c *svcContext) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr + ` | ` // for logging
-		r.ParseMultipartForm(32 << 20)
-		file, handler, err := r.FormFile("uploadfile")
+		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
 
-		defer file.Close()
-		str := fmt.Sprintf("Handler.Header: %v", handler.Header)
-		c.trace(ip, str)
-		path := r.FormValue("path")
-		c.trace("path: " + path)
-		_, fstr := filepath.Split(handler.Filename)
-		if path == "root" {
-			fp, _ := getModuleFileName()
-			fstr = filepath.Dir(fp) + `\` + fstr
-		} else {
-			fstr = path + `\` + fstr
+		defer r.Body.Close()
+		q := r.URL.Query()
+		name := ""
+		if len(body) > 0 {
+			name = validateName(q.Get("file"), false)
+			if frag := q.Get("fragment"); frag != "" {
+				if !isFragmentName(frag) {
+					http.Error(w, "invalid fragment name (<name>.conf or <name>.json)", 500)
+					return
+				}
+
+				name = validateName(frag, true)
+			}
 		}
 
-		f, err := os.Create(fstr)
+		count := 3
+		if val := q.Get("count"); val != "" {
+			if count, err = strconv.Atoi(val); err != nil || count < 0 || count > 100 {
+				http.Error(w, "invalid count (0-100)", 500)
+				return
+			}
+		}
+
+		b, err := json.Marshal(validateConf(name, body, count))
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
 
-		defer f.Close()
-		io.Copy(f, file)
-		// Send full path of file as reply.
-		w.Write([]byte(`{"file":"` + fstr + `"}`))
+		w.Write(b)
 	})
 }
 
-// Returns true if the command line is scheduled (should run). The second value is the total target minutes when
-// the schedule option takes the '*/frequency' form. If zero, that means, the scheduled time is specific.
-func isCmdLineScheduled(c *svcContext, line string) (bool, uint64) {
-	star5 := 0 // special case
-	var target uint64 = 0
-	mults := [5]uint64{
-		1,     // minutes in a minute
-		60,    // minutes in an hour
-		1440,  // minutes in a day
-		43800, // minutes in a month
-		0,     // skip (always exact weekday)
-	}
+// Returns the recorded runs, oldest first. Query parameters (all optional): 'job' (job id, name or
+// location, i.e. run.conf:12, exec for /exec runs), 'since' (RFC3339 time or a duration back from
+// now, i.e. 24h) and 'limit' (most recent runs, default 100).
+func handleHttpGetRuns(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var since time.Time
+		if val := q.Get("since"); val != "" {
+			t, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				d, derr := time.ParseDuration(val)
+				if derr != nil {
+					http.Error(w, "invalid since (RFC3339 time or a duration, i.e. 24h)", 500)
+					return
+				}
 
-	evals := [5]bool{false, false, false, false, false}
-	tms := [5]int{
-		time.Now().Minute(),
-		time.Now().Hour(),
-		time.Now().Day(),
-		int(time.Now().Month()),
-		int(time.Now().Weekday()),
-	}
+				t = time.Now().Add(-d)
+			}
 
-	c.trace("reftime: ", tms)
-	r := fmt.Sprintf("^(%d|\\*|\\*/\\d+)\\s(%d|\\*|\\*/\\d+)\\s(%d|\\*|\\*/\\d+)\\s(%d|\\*|\\*/\\d+)\\s(%d|\\*|\\*/\\d+)",
-		tms[0],
-		tms[1],
-		tms[2],
-		tms[3],
-		tms[4])
-
-	c.trace("regexp: ", r)
-	items := strings.Split(line, " ")
-	match, _ := regexp.MatchString(r, line)
-	if match {
-		for idx, item := range items {
-			// Only the first 5 items are needed.
-			if idx > 4 {
-				break
+			since = t
+		}
+
+		limit := 100
+		if val := q.Get("limit"); val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				http.Error(w, "invalid limit", 500)
+				return
 			}
 
-			if item == "*" {
-				evals[idx] = true
-				star5 += 1
-				continue
+			limit = n
+		}
+
+		// Same job ids as the jobs endpoints; runs of jobs no longer in the config match by id only.
+		job := q.Get("job")
+		if j := c.config().jobByID(job); j != nil {
+			job = j.id()
+		}
+
+		runs, err := c.history.query(job, since, limit)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		b, err := json.Marshal(map[string]interface{}{"runs": runs})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Write(b)
+	})
+}
+
+// Job output logs. Without parameters, returns the job log folders. With 'job' (job id or location
+// as in the jobs endpoints, or log folder), returns the job's log files, newest first. With 'job'
+// and 'file', returns the content of the log file (decompressed), or its last 'tail' bytes.
+func handleHttpGetLogs(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		job := q.Get("job")
+		if job == "" {
+			c.logs.mtx.Lock()
+			files, err := c.logs.list("")
+			c.logs.mtx.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
 			}
 
-			day := false
-			if idx == 2 {
-				// Day of month (priority over 'day of week').
-				if v, err := strconv.Atoi(item); err == nil {
-					day = true
-					if v == tms[idx] {
-						evals[idx] = true
-						evals[4] = true
-						continue
-					}
+			jobs := []string{}
+			seen := map[string]bool{}
+			for _, f := range files {
+				if !seen[f.job] {
+					seen[f.job] = true
+					jobs = append(jobs, f.job)
 				}
 			}
 
-			if idx == 4 {
-				if !day {
-					// Day of week.
-					if v, err := strconv.Atoi(item); err == nil {
-						if v == tms[idx] {
-							evals[idx] = true
-							evals[2] = true
-							continue
-						}
-					}
-				}
+			b, _ := json.Marshal(map[string]interface{}{"jobs": jobs})
+			w.Write(b)
+			return
+		}
+
+		// Same job ids as the jobs and runs endpoints; other values are log folders, i.e. of jobs no
+		// longer in the config.
+		if j := c.config().jobByID(job); j != nil {
+			job = j.id()
+		}
+
+		job = jobLogDir(job)
+		if file := q.Get("file"); file != "" {
+			rc, err := c.logs.openFile(job, file)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
 			}
 
-			vals := strings.Split(item, "/")
-			if len(vals) == 2 && idx < 4 /* day-of-week not included */ {
-				if val, err := strconv.ParseUint(vals[1], 10, 64); err == nil {
-					target += val * mults[idx]
-					evals[idx] = true
-					continue
+			defer rc.Close()
+			var rd io.Reader = rc
+			if val := q.Get("tail"); val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 {
+					http.Error(w, "invalid tail", 500)
+					return
 				}
-			}
 
-			if v, err := strconv.Atoi(item); err == nil {
-				if v == tms[idx] {
-					evals[idx] = true
-					continue
+				tail := &tailBuffer{max: n}
+				if _, err := io.Copy(tail, rc); err != nil {
+					http.Error(w, err.Error(), 500)
+					return
 				}
+
+				rd = bytes.NewReader(tail.buf)
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.Copy(w, rd)
+			return
+		}
+
+		c.logs.mtx.Lock()
+		files, err := c.logs.list(job)
+		c.logs.mtx.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		type logInfo struct {
+			Name     string    `json:"name"`
+			Size     int64     `json:"size"`
+			Modified time.Time `json:"modified"`
+		}
+
+		sort.Slice(files, func(i, k int) bool { return files[i].name > files[k].name })
+		res := []logInfo{}
+		for _, f := range files {
+			res = append(res, logInfo{Name: f.name, Size: f.size, Modified: f.modTime})
+		}
+
+		b, _ := json.Marshal(map[string]interface{}{"job": job, "files": res})
+		w.Write(b)
+	})
+}
+
+// Returns the jobs of the active job table with their last and next runs. With 'job' (job id or
+// location, i.e. run.conf:12), returns that job only, with its options, next 'count' fire times and
+// last 'count' runs.
+func handleHttpGetJobs(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		count := 5
+		if val, ok := q["count"]; ok {
+			n, err := strconv.Atoi(val[0])
+			if err != nil || n < 1 || n > 100 {
+				http.Error(w, "count should be between 1 and 100", 500)
+				return
 			}
+
+			count = n
 		}
 
-		valid := true
-		for _, eval := range evals {
-			if !eval {
-				valid = false
-				break
+		cf := c.config()
+		var res interface{}
+		if id := q.Get("job"); id != "" {
+			j := cf.jobByID(id)
+			if j == nil {
+				http.Error(w, "job not found: "+id, 500)
+				return
+			}
+
+			res = c.jobInfo(j, true, count)
+		} else {
+			jobs := []*jobInfo{}
+			for _, j := range cf.jobs {
+				jobs = append(jobs, c.jobInfo(j, false, 0))
 			}
+
+			res = map[string]interface{}{"jobs": jobs}
 		}
 
-		// When all inputs are '*'s, we set target to '1'.
-		if star5 == 5 && target == 0 {
-			target = 1
+		b, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
 
-		c.trace("evals: ", evals)
-		c.trace("target: ", target)
-		return valid, target
-	}
+		w.Write(b)
+	})
+}
+
+// Run job 'job' now.
+func handleHttpPostJobRun(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("job")
+		j := c.config().jobByID(id)
+		if j == nil {
+			http.Error(w, "job not found: "+id, 500)
+			return
+		}
+
+		c.traceInfo(r.RemoteAddr, " | run job: ", j.id())
+		if err := c.runNow(j); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 
-	return false, 0
+		b, _ := json.Marshal(map[string]interface{}{"job": j.id(), "queued": true})
+		w.Write(b)
+	})
 }
 
-func handleMainExecute(c *svcContext, count uint64) error {
-	atomic.StoreInt32(&c.busy, 1)
-	defer atomic.StoreInt32(&c.busy, 0)
+// Enable or disable job 'job'.
+func handleHttpPostJobEnable(c *svcContext, enabled bool) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.traceInfo(r.RemoteAddr, " | enable job: ", r.URL.Query().Get("job"), ", ", enabled)
+		id, err := c.setEnabled(r.URL.Query().Get("job"), enabled)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 
-	path, err := getModuleFileName()
-	if err != nil {
-		c.trace(err)
-		return err
-	}
+		b, _ := json.Marshal(map[string]interface{}{"job": id, "enabled": enabled})
+		w.Write(b)
+	})
+}
 
-	dir, _ := filepath.Abs(filepath.Dir(path))
-	lines, err := readLines(dir + "\\run.conf")
-	if err != nil {
-		c.trace(err)
-		return err
-	}
+// Add a one-off task. The body is a JSON object with the run time ('at', RFC3339), the command and
+// job options as in jobs.json, i.e. {"at": "2024-01-01T02:00:00+09:00", "command": "cmd.exe /c
+// patch.bat", "timeout": "30m"}. Returns the task with its id.
+func handleHttpPostAt(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var t atTask
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&t); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 
-	activeLinesExact := map[string]bool{}
-	var start, end []int
-	for _, str := range lines {
-		s := strings.TrimSpace(str)
-		var s2 []string
-		// Skip blank lines...
-		if len(str) == 0 {
-			continue
+		c.traceInfo(r.RemoteAddr, " | add task at ", t.At)
+		task, err := c.addTask(t)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
 
-		// and comments.
-		if s[0] == '#' {
-			continue
+		b, err := json.Marshal(task)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
 
-		items := strings.Split(s, " ")
-		c.trace(items)
-		for i, e := range items {
-			if len(e) == 0 {
-				continue
-			}
+		w.Write(b)
+	})
+}
 
-			if e[0] == '"' {
-				start = append(start, i)
-			}
+// Returns the pending one-off tasks in run order.
+func handleHttpGetAt(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mtx.Lock()
+		b, err := json.Marshal(map[string]interface{}{"tasks": c.pendingTasks()})
+		c.mtx.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 
-			if e[len(e)-1] == '"' {
-				end = append(end, i)
-			}
+		w.Write(b)
+	})
+}
+
+// Cancel pending task 'id'.
+func handleHttpPostAtCancel(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid id", 500)
+			return
 		}
 
-		// Extract double-quoted arguments.
-		c.trace("Double-quoted arguments indeces:")
-		tr := fmt.Sprintf("  start:%v, end:%v", start, end)
-		c.trace(tr)
-		for i, e := range start {
-			s2 = append(s2, strings.Join(items[e:end[i]+1], " "))
+		c.traceInfo(r.RemoteAddr, " | cancel task: ", id)
+		if err := c.cancelTask(id); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
 
-		// Reconstruct arguments list.
-		var items2 []string
-		skip := false
-		j := 0
-		for _, e := range items {
-			if len(e) == 0 {
-				continue
-			}
+		b, _ := json.Marshal(map[string]interface{}{"id": id, "cancelled": true})
+		w.Write(b)
+	})
+}
 
-			if e[0] == '"' {
-				items2 = append(items2, s2[j])
-				j += 1
-				skip = true
-			} else {
-				if e[len(e)-1] == '"' {
-					skip = false
-				} else {
-					if !skip {
-						items2 = append(items2, e)
-					}
-				}
-			}
+// Returns the blackout windows from the config and the ones added through the http interface.
+func handleHttpGetBlackouts(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		res := []*blackoutInfo{}
+		for _, b := range c.allBlackouts() {
+			res = append(res, b.info(now))
 		}
 
-		// Should be at least sched params + a single cmd.
-		if len(items2) < 6 {
-			continue
+		b, err := json.Marshal(map[string]interface{}{"blackouts": res})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
 
-		c.trace("Arguments list:")
-		items2 = append(items2[:0], items2[5:]...)
-		for _, e := range items2 {
-			c.trace("  " + e)
+		w.Write(b)
+	})
+}
+
+// Add a blackout window. The body is a window as in jobs.json, i.e. {"schedule": "0 22 * * FRI",
+// "duration": "4h", "tags": ["web"]} or {"from": "2024-01-10T09:00:00+09:00", "to":
+// "2024-01-10T18:00:00+09:00"}. Returns the window with its id.
+func handleHttpPostBlackout(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var d blackoutDef
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&d); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
 
-		// Run the command line.
-		sched, target := isCmdLineScheduled(c, s)
-		if target > 0 {
-			c.trace("count: ", count)
-			if math.Mod(float64(count), float64(target)) != 0 {
-				sched = false
-			}
+		c.traceInfo(r.RemoteAddr, " | add blackout window")
+		bo, err := c.addBlackout(d)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
 
-		if sched {
-			exec := true
-			if v, found := c.mruns[s]; found {
-				if v == true {
-					c.trace("Exact sched: should exec once (already executed).")
-					exec = false
-				}
-			}
+		b, err := json.Marshal(bo.info(time.Now()))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 
-			if exec {
-				c.traceInfo("Execute: ", items2)
-				con, err := execute(items2)
-				if err != nil {
-					c.traceError(err)
-				} else {
-					scon := fmt.Sprintf("%s", con)
-					c.traceInfo("console: " + scon)
-				}
-			}
+		w.Write(b)
+	})
+}
 
-			if target == 0 {
-				// We store this line since for the 'exact time' type of schedule, we need to execute
-				// only once per every minute tick. For the 'every x time' type, we don't mind.
-				//
-				// Example, if the sched is * 1 * * *, that means once every hour. Since our tick is
-				// per minute, this will normally execute once per min at 1:00am (total of 60 execs).
-				// We don't want that to happen.
-				activeLinesExact[s] = true
-				c.mruns[s] = true
-			}
+// Remove blackout window 'id' (windows from the config can only be removed there).
+func handleHttpPostBlackoutRemove(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid id", 500)
+			return
 		}
 
-		s2 = nil
-		start = nil
-		end = nil
-		c.trace("\n")
-	}
+		c.traceInfo(r.RemoteAddr, " | remove blackout window: ", id)
+		if err := c.removeBlackout(id); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		b, _ := json.Marshal(map[string]interface{}{"id": id, "removed": true})
+		w.Write(b)
+	})
+}
 
-	// Cleanup mruns.
-	var delkeys []string
-	for k, v := range c.mruns {
-		_, active := activeLinesExact[k]
-		if !active && v == true {
-			delkeys = append(delkeys, k)
+// Returns the status of the active job table and the errors of the last run.conf read, if any.
+func handleHttpGetConfStatus(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mtx.Lock()
+		b, err := json.Marshal(c.confStat)
+		c.mtx.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
-	}
 
-	if len(delkeys) > 0 {
-		for _, k := range delkeys {
-			delete(c.mruns, k)
+		w.Write(b)
+	})
+}
+
+// Upload any file to some location.
+func handleHttpPostUpload(c *svcContext) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := r.RemoteAddr + ` | ` // for logging
+		r.ParseMultipartForm(32 << 20)
+		file, handler, err := r.FormFile("uploadfile")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
-	}
 
-	for k, v := range c.mruns {
-		c.trace("key: ", k, ", val: ", v)
-	}
+		defer file.Close()
+		str := fmt.Sprintf("Handler.Header: %v", handler.Header)
+		c.trace(ip, str)
+		path := r.FormValue("path")
+		c.trace("path: " + path)
+		_, fstr := filepath.Split(handler.Filename)
+		if path == "root" {
+			fp, _ := getModuleFileName()
+			fstr = filepath.Dir(fp) + `\` + fstr
+		} else {
+			fstr = path + `\` + fstr
+		}
 
-	c.trace("----------\n")
-	return nil
+		f, err := os.Create(fstr)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		defer f.Close()
+		io.Copy(f, file)
+		// Send full path of file as reply.
+		w.Write([]byte(`{"file":"` + fstr + `"}`))
+	})
 }
 
-// Our service's main worker function.
-func (c *svcContext) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
-	c.trace("Starting service: ", svcName)
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
-	changes <- svc.Status{State: svc.StartPending}
-	c.mruns = map[string]bool{}
-	tickdef := 1 * time.Minute
-
-	var (
-		cntr uint64 = 0
-		busy int32
-	)
-
-	// Start our main http interface.
-	go func() {
-		mux := mux.NewRouter()
-		v1 := mux.PathPrefix("/api/v1").Subrouter()
-		v1.Methods("GET").Path("/version").Handler(handleHttpGetInternalVersion(c))
-		v1.Methods("GET").Path("/exec").Handler(handleHttpGetExec(c))
-		v1.Methods("GET").Path("/filestat").Handler(handleHttpGetFileStat(c))
-		v1.Methods("GET").Path("/readfile").Handler(handleHttpGetReadFile(c))
-		v1.Methods("POST").Path("/update/self").Handler(handleHttpPostUpdateSelf(c))
-		v1.Methods("POST").Path("/update/runner").Handler(handleHttpPostUpdateGitlabRunner(c))
-		v1.Methods("POST").Path("/update/conf").Handler(handleHttpPostUpdateConf(c))
-		v1.Methods("POST").Path("/upload").Handler(handleHttpPostUpload(c))
-		n := negroni.Classic()
-		n.UseHandler(mux)
-		c.trace("Launching http interface.")
-		graceful.Run(":8080", 5*time.Minute, n)
-	}()
-
-	maintick := time.Tick(tickdef)
-	slowtick := time.Tick(2 * time.Second)
-	tick := maintick
-	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
-loop:
-	for {
-		select {
-		case <-tick:
-			cntr = cntr + 1
-			if cntr == math.MaxUint64 {
-				cntr = 1
-			}
+// Evaluate all jobs of the active job table for the fire times in ('from', 'now']. Normally this is just 'now'; a
+// window wider than MISFIRE_GRACE means we missed some (service stopped, paused, system suspended, etc.) and each job's
+// misfire policy decides what to do with them. Due jobs are started without waiting for them.
+func handleMainExecute(c *svcContext, from, now time.Time) error {
+	cf := c.config()
+	c.trace("window: ", from, " - ", now)
+	for _, j := range cf.jobs {
+		c.trace(j.where(), ": ", j.spec, " ", j.args)
+		due := j.dueTimes(from, now)
+		if len(due) > 0 && c.isDisabled(j) {
+			c.traceInfo(j.where(), ": job disabled. Skip.")
+			continue
+		}
 
-			busy = atomic.LoadInt32(&c.busy)
-			if busy == 0 {
-				go func(ctx *svcContext, count uint64) {
-					handleMainExecute(ctx, count)
-				}(c, cntr)
-			} else {
-				c.trace(`Function 'handleMainExecute' busy. Skip.`)
-			}
-		case crq := <-r:
-			switch crq.Cmd {
-			case svc.Interrogate:
-				changes <- crq.CurrentStatus
-				// Testing deadlock from https://code.google.com/p/winsvc/issues/detail?id=4
-				time.Sleep(100 * time.Millisecond)
-				changes <- crq.CurrentStatus
-			case svc.Stop, svc.Shutdown:
-				break loop
-			case svc.Pause:
-				changes <- svc.Status{State: svc.Paused, Accepts: cmdsAccepted}
-				tick = slowtick
-			case svc.Continue:
-				changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
-				tick = maintick
-			default:
-				c.traceError("Unexpected control request #", crq)
+		for _, t := range due {
+			if now.Sub(t) >= MISFIRE_GRACE {
+				c.traceInfo(j.where(), ": catch-up (misfire=", j.misfire, ") for missed run at ", t)
 			}
 		}
+
+		if len(due) > 0 {
+			c.dispatchDelayed(j, due)
+		}
 	}
 
-	changes <- svc.Status{State: svc.StopPending}
-	return
+	c.runDueTasks(now)
+
+	c.trace("----------\n")
+	return nil
 }
 
-func runService(name string) {
-	var err error
-	ctx := svcContext{etw: newEtw(), busy: 0}
-	// Setup event log access
-	el, err = eventlog.Open(name)
-	if err != nil {
-		ctx.trace("Cannot initialize event log: ", err)
-		return
-	}
+// Start all @reboot jobs. Called once when the service starts.
+func handleRebootExecute(c *svcContext) {
+	for _, j := range c.config().jobs {
+		if j.isReboot() {
+			if c.isDisabled(j) {
+				c.traceInfo(j.where(), ": @reboot, job disabled. Skip.")
+				continue
+			}
 
-	eInfo("Service start: ", name)
-	run := svc.Run
-	err = run(name, &ctx)
-	if err != nil {
-		ctx.traceError("Service failed: ", err)
-		return
+			c.traceInfo(j.where(), ": @reboot")
+			c.dispatchDelayed(j, []time.Time{time.Now()})
+		}
 	}
-
-	ctx.traceInfo("Service stopped: ", name)
 }
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// The service itself only runs on Windows. Other builds are for running the scheduler's tests, so
+// the traces go to the standard logger.
+type etw struct{}
+
+func (e *etw) trace(v ...interface{}) {}
+
+func (e *etw) traceInfo(v ...interface{}) {
+	log.Print(v...)
+}
+
+func (e *etw) traceError(v ...interface{}) {
+	log.Print(v...)
+}
+
+func newEtw() *etw {
+	return &etw{}
+}
+
+func (c *svcContext) setUpdateSelfAfterReboot(old string, new string) error {
+	return fmt.Errorf("not supported")
+}
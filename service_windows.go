@@ -0,0 +1,298 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/gorilla/mux"
+	"github.com/tylerb/graceful"
+	"github.com/urfave/negroni"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/debug"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+var el debug.Log
+
+type etw struct {
+	mod  *syscall.LazyDLL
+	proc *syscall.LazyProc
+	init bool
+}
+
+func (e *etw) trace(v ...interface{}) {
+	if !e.init {
+		return
+	}
+
+	pc, _, _, _ := runtime.Caller(1)
+	fn := runtime.FuncForPC(pc)
+	fno := regexp.MustCompile(`^.*\.(.*)$`)
+	fnName := fno.ReplaceAllString(fn.Name(), "$1")
+	m := fmt.Sprint(v...) // does not insert space in between items.
+	_, _, _ = e.proc.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr("[" + fnName + "] " + m))))
+}
+
+// Trace + eventlog info entry.
+func (e *etw) traceInfo(v ...interface{}) {
+	if !e.init {
+		return
+	}
+
+	pc, _, _, _ := runtime.Caller(1)
+	fn := runtime.FuncForPC(pc)
+	fno := regexp.MustCompile(`^.*\.(.*)$`)
+	fnName := fno.ReplaceAllString(fn.Name(), "$1")
+	m := fmt.Sprint(v...) // does not insert space in between items.
+	_, _, _ = e.proc.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr("[" + fnName + "] " + m))))
+	el.Info(1, m)
+}
+
+// Trace + eventlog error entry.
+func (e *etw) traceError(v ...interface{}) {
+	if !e.init {
+		return
+	}
+
+	pc, _, _, _ := runtime.Caller(1)
+	fn := runtime.FuncForPC(pc)
+	fno := regexp.MustCompile(`^.*\.(.*)$`)
+	fnName := fno.ReplaceAllString(fn.Name(), "$1")
+	m := fmt.Sprint(v...) // does not insert space in between items.
+	_, _, _ = e.proc.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr("[" + fnName + "] " + m))))
+	el.Error(1, m)
+}
+
+func newEtw() *etw {
+	path, _ := getModuleFileName()
+	lib := filepath.Dir(path) + `\disptrace.dll`
+	if _, err := os.Stat(lib); os.IsNotExist(err) {
+		return nil
+	}
+
+	mod := syscall.NewLazyDLL(lib)
+	proc := mod.NewProc("ETWTrace")
+	return &etw{mod: mod, proc: proc, init: true}
+}
+
+func (c *svcContext) setUpdateSelfAfterReboot(old string, new string) error {
+	var (
+		sysproc                     = syscall.MustLoadDLL("kernel32.dll").MustFindProc("MoveFileExW")
+		MOVEFILE_DELAY_UNTIL_REBOOT = 0x4
+	)
+
+	o, err := syscall.UTF16PtrFromString(old)
+	if err != nil {
+		c.trace(err)
+	}
+
+	n, err := syscall.UTF16PtrFromString(new)
+	if err != nil {
+		c.trace(err)
+	}
+
+	// Register file replacements.
+	_, _, _ = sysproc.Call(uintptr(unsafe.Pointer(o)), 0, uintptr(MOVEFILE_DELAY_UNTIL_REBOOT))
+	_, _, _ = sysproc.Call(uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(o)), uintptr(MOVEFILE_DELAY_UNTIL_REBOOT))
+	_, _, _ = sysproc.Call(uintptr(unsafe.Pointer(n)), 0, uintptr(MOVEFILE_DELAY_UNTIL_REBOOT))
+	return nil
+}
+
+// Our service's main worker function.
+func (c *svcContext) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
+	c.trace("Starting service: ", svcName)
+	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
+	changes <- svc.Status{State: svc.StartPending}
+	c.jobs = map[string]*jobState{}
+	c.history = newRunHistory(historyFile())
+	c.logs = newJobLogs(logsDir())
+	paused := false
+
+	// Resume from the last evaluated time before we were stopped (if any).
+	st, err := loadState()
+	if err != nil {
+		c.traceError("Cannot load state: ", err)
+	}
+
+	c.last = st.Last
+	if c.last.IsZero() {
+		c.last = time.Now().Truncate(time.Second)
+	}
+
+	c.disabled = map[string]bool{}
+	for _, id := range st.Disabled {
+		c.disabled[id] = true
+	}
+
+	c.tasks, c.taskSeq = map[int]*atTask{}, st.TaskSeq
+	for _, t := range st.Tasks {
+		c.tasks[t.ID] = t
+	}
+
+	c.blackouts, c.blackoutSeq = map[int]*blackout{}, st.BlackoutSeq
+	for _, d := range st.Blackouts {
+		b, err := d.toBlackout(nil)
+		if err != nil {
+			c.traceError("Invalid blackout window in state: ", err)
+			continue
+		}
+
+		b.src = fmt.Sprintf("api:%d", d.ID)
+		c.blackouts[d.ID] = b
+	}
+
+	c.wakec = make(chan struct{}, 1)
+	c.loadLastRuns()
+
+	// Before the http interface, since its handlers need the job table.
+	c.reloadConf()
+
+	// Start our main http interface.
+	go func() {
+		mux := mux.NewRouter()
+		v1 := mux.PathPrefix("/api/v1").Subrouter()
+		v1.Methods("GET").Path("/version").Handler(handleHttpGetInternalVersion(c))
+		v1.Methods("GET").Path("/exec").Handler(handleHttpGetExec(c))
+		v1.Methods("GET").Path("/runs").Handler(handleHttpGetRuns(c))
+		v1.Methods("GET").Path("/logs").Handler(handleHttpGetLogs(c))
+		v1.Methods("GET").Path("/jobs").Handler(handleHttpGetJobs(c))
+		v1.Methods("POST").Path("/jobs/run").Handler(handleHttpPostJobRun(c))
+		v1.Methods("POST").Path("/jobs/enable").Handler(handleHttpPostJobEnable(c, true))
+		v1.Methods("POST").Path("/jobs/disable").Handler(handleHttpPostJobEnable(c, false))
+		v1.Methods("GET").Path("/at").Handler(handleHttpGetAt(c))
+		v1.Methods("POST").Path("/at").Handler(handleHttpPostAt(c))
+		v1.Methods("POST").Path("/at/cancel").Handler(handleHttpPostAtCancel(c))
+		v1.Methods("GET").Path("/blackouts").Handler(handleHttpGetBlackouts(c))
+		v1.Methods("POST").Path("/blackouts").Handler(handleHttpPostBlackout(c))
+		v1.Methods("POST").Path("/blackouts/remove").Handler(handleHttpPostBlackoutRemove(c))
+		v1.Methods("GET").Path("/schedule/next").Handler(handleHttpGetScheduleNext(c))
+		v1.Methods("GET").Path("/filestat").Handler(handleHttpGetFileStat(c))
+		v1.Methods("GET").Path("/readfile").Handler(handleHttpGetReadFile(c))
+		v1.Methods("POST").Path("/update/self").Handler(handleHttpPostUpdateSelf(c))
+		v1.Methods("POST").Path("/update/runner").Handler(handleHttpPostUpdateGitlabRunner(c))
+		v1.Methods("POST").Path("/update/conf").Handler(handleHttpPostUpdateConf(c))
+		v1.Methods("GET").Path("/conf/status").Handler(handleHttpGetConfStatus(c))
+		v1.Methods("POST").Path("/conf/validate").Handler(handleHttpPostConfValidate(c))
+		v1.Methods("POST").Path("/upload").Handler(handleHttpPostUpload(c))
+		n := negroni.Classic()
+		n.UseHandler(mux)
+		c.trace("Launching http interface.")
+		graceful.Run(":8080", 5*time.Minute, n)
+	}()
+
+	handleRebootExecute(c)
+
+	// Instead of a fixed tick, we sleep until the next fire time of any job or task (or the next
+	// minute at most). run.conf is checked for changes separately.
+	wake := c.nextWake(time.Now())
+	timer := time.NewTimer(time.Until(wake))
+	resetTimer := func() {
+		wake = c.nextWake(c.last)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		timer.Reset(time.Until(wake))
+	}
+
+	poll := time.NewTicker(CONF_POLL)
+	defer poll.Stop()
+	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+loop:
+	for {
+		select {
+		case <-timer.C:
+			// If we woke up late, the fire times in between are still due; only the ones older than
+			// MISFIRE_GRACE (i.e. system suspended) are missed ones.
+			now := time.Now().Truncate(time.Second)
+			if now.Before(wake) {
+				now = wake
+			}
+
+			wake = c.nextWake(now)
+			timer.Reset(time.Until(wake))
+			if !now.After(c.last) {
+				c.trace("Already evaluated: ", now)
+				continue
+			}
+
+			// Don't move our last evaluated time while paused so the missed fire times are still
+			// covered by the next evaluation.
+			if paused {
+				c.trace("Service paused. Skip.")
+				continue
+			}
+
+			handleMainExecute(c, c.last, now)
+			c.mtx.Lock()
+			c.last = now
+			c.mtx.Unlock()
+			if err := c.saveState(); err != nil {
+				c.trace("Cannot save state: ", err)
+			}
+		case <-poll.C:
+			// New jobs may fire before our current wake up time. Fire times since the last evaluation
+			// are still covered by the next one.
+			if c.reloadConf() {
+				resetTimer()
+			}
+		case <-c.wakec:
+			// A new task may be due before our current wake up time.
+			resetTimer()
+		case crq := <-r:
+			switch crq.Cmd {
+			case svc.Interrogate:
+				changes <- crq.CurrentStatus
+				// Testing deadlock from https://code.google.com/p/winsvc/issues/detail?id=4
+				time.Sleep(100 * time.Millisecond)
+				changes <- crq.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				break loop
+			case svc.Pause:
+				changes <- svc.Status{State: svc.Paused, Accepts: cmdsAccepted}
+				paused = true
+			case svc.Continue:
+				changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+				paused = false
+			default:
+				c.traceError("Unexpected control request #", crq)
+			}
+		}
+	}
+
+	changes <- svc.Status{State: svc.StopPending}
+	return
+}
+
+func runService(name string) {
+	var err error
+	ctx := svcContext{etw: newEtw()}
+	// Setup event log access
+	el, err = eventlog.Open(name)
+	if err != nil {
+		ctx.trace("Cannot initialize event log: ", err)
+		return
+	}
+
+	eInfo("Service start: ", name)
+	run := svc.Run
+	err = run(name, &ctx)
+	if err != nil {
+		ctx.traceError("Service failed: ", err)
+		return
+	}
+
+	ctx.traceInfo("Service stopped: ", name)
+}
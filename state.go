@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Scheduler state that should survive service restarts. Saved as JSON in the service's folder.
+type svcState struct {
+	Last     time.Time `json:"last"`               // last evaluated fire time
+	Disabled []string  `json:"disabled,omitempty"` // ids of the jobs disabled through the http interface
+	Tasks    []*atTask `json:"at,omitempty"`       // pending one-off tasks
+	TaskSeq  int       `json:"atseq,omitempty"`    // last task id
+
+	Blackouts   []blackoutDef `json:"blackouts,omitempty"` // windows added through the http interface
+	BlackoutSeq int           `json:"blackoutseq,omitempty"`
+}
+
+func stateFile() string {
+	path, _ := getModuleFileName()
+	return filepath.Dir(path) + `\state.json`
+}
+
+// A missing state file is not an error; we just start fresh.
+func loadState() (*svcState, error) {
+	var st svcState
+	b, err := ioutil.ReadFile(stateFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &st, nil
+		}
+
+		return &st, err
+	}
+
+	err = json.Unmarshal(b, &st)
+	return &st, err
+}
+
+// Write to a temporary file first so a crash while saving doesn't leave a truncated state file.
+func saveState(st *svcState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	tmp := stateFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, stateFile())
+}
+
+// Save the current state. Called from the main loop and the http handlers, so the saves are
+// serialized and each one writes the latest state.
+func (c *svcContext) saveState() error {
+	c.stateMtx.Lock()
+	defer c.stateMtx.Unlock()
+	c.mtx.Lock()
+	st := svcState{Last: c.last, TaskSeq: c.taskSeq, BlackoutSeq: c.blackoutSeq}
+	if len(c.tasks) > 0 {
+		st.Tasks = c.pendingTasks()
+	}
+
+	for _, b := range c.blackouts {
+		st.Blackouts = append(st.Blackouts, b.def)
+	}
+
+	for id := range c.disabled {
+		st.Disabled = append(st.Disabled, id)
+	}
+
+	c.mtx.Unlock()
+	sort.Strings(st.Disabled)
+	sort.Slice(st.Blackouts, func(i, k int) bool { return st.Blackouts[i].ID < st.Blackouts[k].ID })
+	return saveState(&st)
+}
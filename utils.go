@@ -1,7 +1,9 @@
+//go:build windows
+// +build windows
+
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"os"
 	"os/exec"
@@ -27,23 +29,6 @@ func eError(v ...interface{}) {
 	el.Error(1, m)
 }
 
-// readLines reads a whole file into memory and returns a slice of its lines.
-func readLines(path string) ([]string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-
-	defer file.Close()
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-
-	return lines, scanner.Err()
-}
-
 // Get the full name (with path) of the executing module.
 func getModuleFileName() (string, error) {
 	var sysproc = syscall.MustLoadDLL("kernel32.dll").MustFindProc("GetModuleFileNameW")
@@ -57,64 +42,6 @@ func getModuleFileName() (string, error) {
 	return string(utf16.Decode(b[0:n])), nil
 }
 
-// Up to 15 args only.
-func execute(args []string) ([]byte, error) {
-	var (
-		con []byte
-		err error
-	)
-
-	switch len(args) {
-	case 1:
-		cmd := exec.Command(args[0])
-		con, err = cmd.Output()
-	case 2:
-		cmd := exec.Command(args[0], args[1])
-		con, err = cmd.Output()
-	case 3:
-		cmd := exec.Command(args[0], args[1], args[2])
-		con, err = cmd.Output()
-	case 4:
-		cmd := exec.Command(args[0], args[1], args[2], args[3])
-		con, err = cmd.Output()
-	case 5:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4])
-		con, err = cmd.Output()
-	case 6:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5])
-		con, err = cmd.Output()
-	case 7:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5], args[6])
-		con, err = cmd.Output()
-	case 8:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7])
-		con, err = cmd.Output()
-	case 9:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8])
-		con, err = cmd.Output()
-	case 10:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8], args[9])
-		con, err = cmd.Output()
-	case 11:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8], args[9], args[10])
-		con, err = cmd.Output()
-	case 12:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8], args[9], args[10], args[11])
-		con, err = cmd.Output()
-	case 13:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8], args[9], args[10], args[11], args[12])
-		con, err = cmd.Output()
-	case 14:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8], args[9], args[10], args[11], args[12], args[13])
-		con, err = cmd.Output()
-	case 15:
-		cmd := exec.Command(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8], args[9], args[10], args[11], args[12], args[13], args[14])
-		con, err = cmd.Output()
-	}
-
-	return con, err
-}
-
 // Run process as SYSTEM in the same session as winlogon.exe, not session 0.
 func runInteractive(cmd string, args string, wait bool, waitms int) (uint32, error) {
 	path, _ := getModuleFileName()
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Get the full name (with path) of the executing module.
+func getModuleFileName() (string, error) {
+	return os.Executable()
+}
+
+func runInteractive(cmd string, args string, wait bool, waitms int) (uint32, error) {
+	return 0, fmt.Errorf("not supported")
+}
+
+func rebootSystem() error {
+	return fmt.Errorf("not supported")
+}
+
+func isRunnerActive() bool {
+	return false
+}
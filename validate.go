@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A job as understood by the scheduler, for checking a config before it's applied.
+type validateJob struct {
+	Source   string   `json:"source"` // i.e. run.conf:12
+	Name     string   `json:"name,omitempty"`
+	Schedule string   `json:"schedule"` // normalized, i.e. '@daily' is '0 0 0 * * *'
+	Args     []string `json:"args"`
+	Next     []string `json:"next"` // next fire times, RFC3339
+}
+
+type validateResult struct {
+	Valid  bool          `json:"valid"` // no errors; the config would be applied
+	Errors []string      `json:"errors"`
+	Jobs   []validateJob `json:"jobs"`
+}
+
+// Returns the config file name (as in confSource) for a file to check: 'fragment' means it goes to
+// run.conf.d, otherwise it's jobs.json for *.json and run.conf for anything else.
+func validateName(file string, fragment bool) string {
+	base := filepath.Base(strings.Replace(file, `\`, "/", -1))
+	switch {
+	case fragment:
+		return `run.conf.d\` + base
+	case strings.ToLower(filepath.Ext(base)) == ".json":
+		return "jobs.json"
+	}
+
+	return "run.conf"
+}
+
+// Parse the service's config with the file 'name' replaced by (or added as) 'b', without applying
+// it. The whole config is parsed since it's applied as a whole, i.e. chains can refer to jobs in
+// other files. Only the jobs from 'name' are returned; all of them if 'name' is empty.
+func validateConf(name string, b []byte, count int) *validateResult {
+	cf, errs := readConfWith(name, b)
+	res := validateResult{Valid: len(errs) == 0, Errors: []string{}, Jobs: []validateJob{}}
+	for _, err := range errs {
+		res.Errors = append(res.Errors, err.Error())
+	}
+
+	now := time.Now()
+	for _, j := range cf.jobs {
+		if name != "" && j.src != name {
+			continue
+		}
+
+		vj := validateJob{Source: j.where(), Name: j.name, Schedule: j.sched.String(), Args: j.args, Next: []string{}}
+		for _, t := range nextTimes(j.sched, now, count) {
+			vj.Next = append(vj.Next, t.Format(time.RFC3339))
+		}
+
+		res.Jobs = append(res.Jobs, vj)
+	}
+
+	return &res
+}
+
+// Print the result for the 'validate' command.
+func (res *validateResult) print(w io.Writer) {
+	for _, err := range res.Errors {
+		fmt.Fprintln(w, "error:", err)
+	}
+
+	for _, j := range res.Jobs {
+		fmt.Fprintln(w, j.Source+":", j.Name)
+		fmt.Fprintln(w, "  schedule:", j.Schedule)
+		fmt.Fprintf(w, "  args:     %q\n", j.Args)
+		for i, t := range j.Next {
+			if i == 0 {
+				fmt.Fprintln(w, "  next:    ", t)
+			} else {
+				fmt.Fprintln(w, "           ", t)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "%d job(s), %d error(s)\n", len(res.Jobs), len(res.Errors))
+}